@@ -92,6 +92,7 @@ $(document).on('ready', function () {
 
     $("#tradeLink").click(function () {
         ws.send(JSON.stringify({type: "get_open_trades", v: 2, user: user.username}));
+        ws.send(JSON.stringify({type: 'get_proposals', company: user.name, user: user.username}));
     });
 
     //login events
@@ -148,22 +149,20 @@ $(document).on('ready', function () {
     });
 
     //trade events
-    $(document).on("click", ".buyPaper", function () {
+    $(document).on("click", ".sellPaper", function () {
         if (user.username) {
-            console.log('trading...');
-            var i = $(this).attr('trade_pos');
             var cusip = $(this).attr('data_cusip');
-            var issuer = $(this).attr('data_issuer');
+            var buyer = window.prompt('Which company should be offered 1 of ' + cusip + '?');
+            if (!buyer) return;
 
-            // TODO Map the trade_pos to the correct button
+            // The transfer only settles once the buyer accepts it
+            console.log('proposing trade...');
             var msg = {
                 type: 'transfer_paper',
                 transfer: {
-                    //CUSIP: bag.papers[i].cusip,
-                    //fromCompany: bag.papers[i].issuer,
                     CUSIP: cusip,
-                    fromCompany: issuer,
-                    toCompany: user.name,
+                    fromCompany: user.name,
+                    toCompany: buyer.trim(),
                     quantity: 1
                 },
                 user: user.username
@@ -173,6 +172,19 @@ $(document).on('ready', function () {
             $("#notificationPanel").animate({width: 'toggle'});
         }
     });
+
+    $(document).on("click", ".acceptTransfer, .rejectTransfer", function () {
+        if (user.username) {
+            var msg = {
+                type: $(this).hasClass('acceptTransfer') ? 'accept_transfer' : 'reject_transfer',
+                proposal: $(this).attr('data_proposal'),
+                user: user.username
+            };
+            console.log('sending', msg);
+            ws.send(JSON.stringify(msg));
+            $(this).closest('tr').remove();
+        }
+    });
 });
 
 
@@ -226,6 +238,7 @@ function connect_to_server() {
         ws.send(JSON.stringify({type: "get_papers", v: 2, user: user.username}));
         if (user.name && user.role !== "auditor") {
             ws.send(JSON.stringify({type: 'get_company', company: user.name, user: user.username}));
+            ws.send(JSON.stringify({type: 'get_proposals', company: user.name, user: user.username}));
         }
     }
 
@@ -255,6 +268,14 @@ function connect_to_server() {
 					console.log('cannot parse papers', e);
 				}
 			}
+			else if (data.msg === 'proposals') {
+				try{
+					build_proposals(JSON.parse(data.proposals));
+				}
+				catch(e){
+					console.log('cannot parse proposals', e);
+				}
+			}
 			else if (data.msg === 'chainstats') {
 				console.log(JSON.stringify(data));
 				var e = formatDate(data.blockstats.transactions[0].timestamp.seconds * 1000, '%M/%d/%Y &nbsp;%I:%m%P');
@@ -280,6 +301,7 @@ function connect_to_server() {
                 ws.send(JSON.stringify({type: "chainstats", v: 2, user: user.username}));
 				if (user.role !== "auditor") {
 					ws.send(JSON.stringify({type: 'get_company', company: user.name, user: user.username}));
+					ws.send(JSON.stringify({type: 'get_proposals', company: user.name, user: user.username}));
 				}
 			}
 			else if (data.type === 'error') {
@@ -350,12 +372,8 @@ function build_trades(papers, panelDesc) {
 
                 if (excluded(entries[i], filter)) {
                     var style;
-                    if (user.name.toLowerCase() === entries[i].owner.toLowerCase()) {
-                        //cannot buy my own stuff
-                        style = 'invalid';
-                    }
-                    else if (entries[i].issuer.toLowerCase() !== entries[i].owner.toLowerCase()) {
-                        //cannot buy stuff already bought
+                    if (user.name.toLowerCase() !== entries[i].owner.toLowerCase()) {
+                        //cannot sell someone else's stuff
                         style = 'invalid';
                     } else {
                         style = null;
@@ -380,9 +398,8 @@ function build_trades(papers, panelDesc) {
                     // Only the trade panel should allow you to interact with trades
                     if (panelDesc.name === "trade") {
                         var disabled = false
-                        if (user.name.toLowerCase() === entries[i].owner.toLowerCase()) disabled = true;			//cannot buy my own stuff
-                        if (entries[i].issuer.toLowerCase() !== entries[i].owner.toLowerCase()) disabled = true;
-                        var button = buyButton(disabled, entries[i].cusip, entries[i].issuer);
+                        if (user.name.toLowerCase() !== entries[i].owner.toLowerCase()) disabled = true;			//cannot sell someone else's stuff
+                        var button = sellButton(disabled, entries[i].cusip);
                         row.appendChild(button);
                     }
                     rows.push(row);
@@ -423,6 +440,35 @@ function build_trades(papers, panelDesc) {
     }
 }
 
+/**
+ * Displays the pending transfer proposals the user is the buyer or seller on.  Only the buyer can answer a proposal.
+ * @param proposals The list of proposals from the server.
+ */
+function build_proposals(proposals) {
+    var tableBody = $("#proposalsBody");
+    tableBody.empty();
+
+    if (!proposals || proposals.length == 0) {
+        tableBody.html('<tr><td>nothing here...</td><td></td><td></td><td></td><td></td></tr>');
+        return;
+    }
+
+    for (var i in proposals) {
+        var row = createRow([
+            proposals[i].cusip,
+            proposals[i].fromCompany,
+            proposals[i].toCompany,
+            proposals[i].quantity
+        ]);
+        if (user.name.toLowerCase() === proposals[i].toCompany.toLowerCase()) {
+            row.appendChild(answerButtons(proposals[i].id));
+        } else {
+            row.appendChild(document.createElement('td'));
+        }
+        tableBody.append(row);
+    }
+}
+
 // =================================================================================
 //	Helpers for the filtering of trades
 // =================================================================================
@@ -17,34 +17,64 @@ function createRow(data) {
 }
 
 /**
- * Generates a buy button cell that users can click to purchase commercial paper.
+ * Generates a sell button cell that users can click to offer one unit of their commercial paper to another company.
+ * The sale only goes through once the buyer accepts it.
  * @param disabled True if the button should be disabled, false otherwise.
  * @param cusip The cusip for the paper that this button is assigned to.
- * @param issuer The issuer of the paper that this button is assigned to.
- * @returns {Element} A table cell with a configured buy button.
+ * @returns {Element} A table cell with a configured sell button.
  */
-function buyButton(disabled, cusip, issuer) {
+function sellButton(disabled, cusip) {
     var button = document.createElement('button');
     button.setAttribute('type', 'button');
     button.setAttribute('data_cusip', cusip);
-    button.setAttribute('data_issuer', issuer);
     if(disabled) button.disabled = true;
-    button.classList.add('buyPaper');
+    button.classList.add('sellPaper');
     button.classList.add('altButton');
 
     var span = document.createElement('span');
     span.classList.add('fa');
     span.classList.add('fa-exchange');
-    span.innerHTML = ' &nbsp;&nbsp;BUY 1';
+    span.innerHTML = ' &nbsp;&nbsp;SELL 1';
     button.appendChild(span);
 
-    // Wrap the buy button in a td like the other items in the row.
+    // Wrap the sell button in a td like the other items in the row.
     var td = document.createElement('td');
     td.appendChild(button);
 
     return td;
 }
 
+/**
+ * Generates a cell with the buttons a buyer uses to accept or reject a transfer proposed to them.
+ * @param proposalID The ID of the transfer proposal.
+ * @returns {Element} A table cell with accept and reject buttons.
+ */
+function answerButtons(proposalID) {
+    var td = document.createElement('td');
+
+    var answers = [
+        {cls: 'acceptTransfer', icon: 'fa-check', text: ' &nbsp;&nbsp;ACCEPT'},
+        {cls: 'rejectTransfer', icon: 'fa-times', text: ' &nbsp;&nbsp;REJECT'}
+    ];
+    for (var i in answers) {
+        var button = document.createElement('button');
+        button.setAttribute('type', 'button');
+        button.setAttribute('data_proposal', proposalID);
+        button.classList.add(answers[i].cls);
+        button.classList.add('altButton');
+
+        var span = document.createElement('span');
+        span.classList.add('fa');
+        span.classList.add(answers[i].icon);
+        span.innerHTML = answers[i].text;
+        button.appendChild(span);
+
+        td.appendChild(button);
+    }
+
+    return td;
+}
+
 function paper_to_entries(paper) {
     var entries = [];
     for (var owner in paper.owner) {
@@ -0,0 +1,324 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Quote is the price and yields of a quantity of paper on a valuation date
+type Quote struct {
+	CUSIP               string  `json:"cusip"`
+	Quantity            int     `json:"quantity"`
+	Currency            string  `json:"currency"`
+	ValuationDate       string  `json:"valuationDate"`
+	Discount            Rate    `json:"discount"`
+	DaysToMaturity      int     `json:"daysToMaturity"`
+	MaturityValue       Money   `json:"maturityValue"`
+	Price               Money   `json:"price"`
+	DiscountYield       float64 `json:"discountYield"`
+	MoneyMarketYield    float64 `json:"moneyMarketYield"`
+	BondEquivalentYield float64 `json:"bondEquivalentYield"`
+}
+
+// quotePaper prices quantity units of the paper at the given rate on the
+// valuation date using the same pricing that settles transfers, and derives
+// the yields from that price. Without a rate the paper is quoted the way a
+// transfer without one would settle. Distressed paper is quoted on what is
+// still owed on it and has no yields.
+func quotePaper(cp CP, quantity int, discount *Rate, valuation time.Time) (Quote, error) {
+	var quote Quote
+
+	if cp.Status == paperMatured || (cp.Status == paperDefaulted && !cp.Distressed) {
+		return quote, errors.New("The paper " + cp.CUSIP + " is " + cp.Status + " and can't be quoted")
+	}
+	if quantity <= 0 {
+		return quote, errors.New("Quote quantity must be positive")
+	}
+
+	days := 0
+	value, err := maturityValue(cp)
+	if err != nil {
+		return quote, err
+	}
+	if cp.Status == paperDefaulted {
+		value -= cp.Recovered
+	} else {
+		days, err = calendarDaysToMaturity(cp, valuation)
+		if err != nil {
+			return quote, err
+		}
+	}
+	rate, price, err := transferPrice(cp, Transaction{CUSIP: cp.CUSIP, Quantity: quantity, Discount: discount}, valuation)
+	if err != nil {
+		return quote, err
+	}
+
+	quote = Quote{
+		CUSIP:          cp.CUSIP,
+		Quantity:       quantity,
+		Currency:       paperCurrency(cp),
+		ValuationDate:  timeToMs(valuation),
+		Discount:       rate,
+		DaysToMaturity: days,
+		MaturityValue:  Money(quantity) * value,
+		Price:          price,
+	}
+	if days == 0 {
+		return quote, nil
+	}
+	maturity, err := maturityDate(cp)
+	if err != nil {
+		return quote, err
+	}
+
+	// The discount and money market yields use the paper's day count, the
+	// bond equivalent yield is always on an actual/365 basis
+	fraction := yearFraction(cp, valuation, maturity)
+	if fraction <= 0 {
+		return quote, nil
+	}
+	gain := (quote.MaturityValue - price).Float()
+	quote.DiscountYield = gain / quote.MaturityValue.Float() / fraction * 100.0
+	quote.MoneyMarketYield = gain / price.Float() / fraction * 100.0
+	quote.BondEquivalentYield = bondEquivalentYield(price.Float(), quote.MaturityValue.Float(), days) * 100.0
+
+	return quote, nil
+}
+
+// bondEquivalentYield converts a price for a payment due in the given number
+// of days into a semi-annual bond equivalent yield. Beyond half a year the
+// paper is compared to a bond paying one coupon before maturity.
+func bondEquivalentYield(price float64, value float64, days int) float64 {
+	fraction := float64(days) / 365.0
+	if days <= 182 {
+		return (value - price) / price / fraction
+	}
+
+	a := fraction / 2.0 - 0.25
+	b := fraction
+	c := (price - value) / price
+	return (-b + math.Sqrt(b * b - 4.0 * a * c)) / (2.0 * a)
+}
+
+// GetQuote prices a CUSIP for the quantity and valuation date in args. The
+// valuation date defaults to the transaction time and the discount to the
+// paper's issuance discount, or to none for distressed paper.
+func GetQuote(args []string, stub shim.ChaincodeStubInterface) (Quote, error) {
+	var quote Quote
+
+	/*		0		1			2					3
+		CUSIP	quantity	valuationDate (ms)	discount
+	*/
+	if len(args) < 2 || len(args) > 4 {
+		return quote, errors.New("Incorrect number of arguments. Expecting CUSIP, quantity and optionally valuation date and discount")
+	}
+
+	cp, err := GetCP(cpPrefix + args[0], stub)
+	if err != nil {
+		return quote, err
+	}
+	quantity, err := strconv.Atoi(args[1])
+	if err != nil {
+		return quote, errors.New("Invalid quantity " + args[1])
+	}
+
+	var valuation time.Time
+	if len(args) > 2 && args[2] != "" {
+		valuation, err = msToTime(args[2])
+		if err != nil {
+			return quote, errors.New("Invalid valuation date " + args[2])
+		}
+	} else {
+		valuation, err = txTime(stub)
+		if err != nil {
+			fmt.Println("Error getting transaction timestamp")
+			return quote, errors.New("A valuation date is required: " + err.Error())
+		}
+	}
+
+	var discount *Rate
+	if len(args) > 3 {
+		units, err := parseDecimal([]byte(args[3]), rateScale)
+		if err != nil {
+			return quote, errors.New("Invalid discount " + args[3])
+		}
+		rate := Rate(units)
+		discount = &rate
+	}
+
+	return quotePaper(cp, quantity, discount, valuation)
+}
+
+// Position is a company's holding of one paper valued on the valuation date
+type Position struct {
+	CUSIP          string `json:"cusip"`
+	Ticker         string `json:"ticker"`
+	Issuer         string `json:"issuer"`
+	Currency       string `json:"currency"`
+	Status         string `json:"status"`
+	Quantity       int    `json:"quantity"`
+	DaysToMaturity int    `json:"daysToMaturity"`
+	Discount       Rate   `json:"discount"`
+	Price          Money  `json:"price"`
+	MarketValue    Money  `json:"marketValue"`
+}
+
+// Portfolio is every position a company holds with the total market value
+// in each currency and in the base currency of the FX rate table
+type Portfolio struct {
+	Company       string           `json:"company"`
+	ValuationDate string           `json:"valuationDate"`
+	Positions     []Position       `json:"positions"`
+	Totals        map[string]Money `json:"totals"`
+	Base          string           `json:"base"`
+	Total         Money            `json:"total"`
+}
+
+// valuePosition values quantity units of the paper on the valuation date.
+// Active paper is priced at its issuance discount on the days it has left,
+// paper past maturity but not yet redeemed at its maturity value and
+// defaulted paper at what is still owed on it.
+func valuePosition(cp CP, quantity int, valuation time.Time) (Position, error) {
+	position := Position{
+		CUSIP:    cp.CUSIP,
+		Ticker:   cp.Ticker,
+		Issuer:   cp.Issuer,
+		Currency: paperCurrency(cp),
+		Status:   cp.Status,
+		Quantity: quantity,
+	}
+	if position.Status == "" {
+		position.Status = paperActive
+	}
+
+	value, err := maturityValue(cp)
+	if err != nil {
+		return position, err
+	}
+
+	if cp.Status == paperDefaulted {
+		position.Price = value - cp.Recovered
+		position.MarketValue = Money(quantity) * position.Price
+		return position, nil
+	}
+
+	days, err := calendarDaysToMaturity(cp, valuation)
+	if err != nil {
+		position.Price = value
+		position.MarketValue = Money(quantity) * value
+		return position, nil
+	}
+	position.DaysToMaturity = days
+	position.Discount = cp.Discount
+	position.Price, err = paperPrice(cp, 1, cp.Discount, valuation)
+	if err != nil {
+		return position, err
+	}
+	position.MarketValue, err = paperPrice(cp, quantity, cp.Discount, valuation)
+	if err != nil {
+		return position, err
+	}
+
+	return position, nil
+}
+
+// GetPortfolio values every paper the company in args holds. The valuation
+// date defaults to the transaction time. Redeemed paper is left out.
+func GetPortfolio(args []string, stub shim.ChaincodeStubInterface) (Portfolio, error) {
+	var portfolio Portfolio
+
+	/*		0			1
+		company ID	valuationDate (ms)
+	*/
+	if len(args) < 1 || len(args) > 2 {
+		return portfolio, errors.New("Incorrect number of arguments. Expecting company ID and optionally valuation date")
+	}
+
+	company, err := GetCompany(args[0], stub)
+	if err != nil {
+		return portfolio, err
+	}
+
+	var valuation time.Time
+	if len(args) > 1 && args[1] != "" {
+		valuation, err = msToTime(args[1])
+		if err != nil {
+			return portfolio, errors.New("Invalid valuation date " + args[1])
+		}
+	} else {
+		valuation, err = txTime(stub)
+		if err != nil {
+			fmt.Println("Error getting transaction timestamp")
+			return portfolio, errors.New("A valuation date is required: " + err.Error())
+		}
+	}
+
+	fx, err := GetFXRates(stub)
+	if err != nil {
+		return portfolio, err
+	}
+	allCPs, err := GetAllCPs(stub)
+	if err != nil {
+		return portfolio, err
+	}
+
+	portfolio = Portfolio{
+		Company:       company.ID,
+		ValuationDate: timeToMs(valuation),
+		Positions:     []Position{},
+		Totals:        map[string]Money{},
+		Base:          fx.Base,
+	}
+
+	// Holdings are read from the papers' owners, AssetsIds on the account
+	// isn't kept up to date when paper is sold
+	for _, cp := range allCPs {
+		if cp.Status == paperMatured {
+			continue
+		}
+		for _, owner := range cp.Owners {
+			if owner.Company != company.ID || owner.Quantity <= 0 {
+				continue
+			}
+			position, err := valuePosition(cp, owner.Quantity, valuation)
+			if err != nil {
+				return portfolio, err
+			}
+			portfolio.Positions = append(portfolio.Positions, position)
+			portfolio.Totals[position.Currency] += position.MarketValue
+		}
+	}
+
+	for currency, amount := range portfolio.Totals {
+		converted, err := toBase(amount, currency, fx)
+		if err != nil {
+			return portfolio, err
+		}
+		portfolio.Total += converted
+	}
+
+	return portfolio, nil
+}
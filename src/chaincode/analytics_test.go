@@ -0,0 +1,70 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDaysToMaturityAreCalendarDays(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+
+	// Later in the day than the paper was issued there is less than a whole
+	// day left, but the price still runs over a calendar day
+	for _, test := range []struct {
+		valuation time.Time
+		days      int
+	}{
+		{stub.now, 30},
+		{stub.now.Add(6 * time.Hour), 30},
+		{stub.now.AddDate(0, 0, 29).Add(6 * time.Hour), 1},
+	} {
+		var quote Quote
+		result, err := query(stub, cc, "company1", "GetQuote", cusip, "1", ms(test.valuation))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(result, &quote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quote.DaysToMaturity != test.days {
+			t.Errorf("quote on %s has %d days to maturity, want %d", test.valuation, quote.DaysToMaturity, test.days)
+		}
+		if quote.BondEquivalentYield <= 0 {
+			t.Errorf("quote on %s has a bond equivalent yield of %f", test.valuation, quote.BondEquivalentYield)
+		}
+
+		var portfolio Portfolio
+		result, err = query(stub, cc, "company1", "GetPortfolio", "company1", ms(test.valuation))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(result, &portfolio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(portfolio.Positions) != 1 || portfolio.Positions[0].DaysToMaturity != test.days {
+			t.Errorf("portfolio on %s is %+v, want one position with %d days to maturity", test.valuation, portfolio.Positions, test.days)
+		}
+	}
+}
@@ -0,0 +1,631 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var auctionPrefix = "auction:"
+
+// Auction and bid status values
+const (
+	auctionOpen      = "open"
+	auctionClosed    = "closed"
+	auctionCancelled = "cancelled"
+	bidSubmitted     = "submitted"
+	bidAllocated     = "allocated"
+	bidUnallocated   = "unallocated"
+	bidDropped       = "dropped"
+)
+
+// AuctionBid is an investor's sealed bid for a quantity of the paper at a
+// discount. Allocated is set when the auction closes.
+type AuctionBid struct {
+	ID        string `json:"id"`
+	Company   string `json:"company"`
+	Quantity  int    `json:"quantity"`
+	Discount  Rate   `json:"discount"`
+	Seq       int    `json:"seq"`
+	Status    string `json:"status"`
+	Allocated int    `json:"allocated"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Auction prices a new issue by single rate (Dutch) auction. It holds the
+// terms of the paper, which is only issued when the auction closes, at the
+// clearing discount and to the winning bidders. MaxDiscount is the highest
+// discount the issuer will accept, if it set one.
+type Auction struct {
+	ID          string       `json:"id"`
+	Issuer      string       `json:"issuer"`
+	Ticker      string       `json:"ticker"`
+	Par         Money        `json:"par"`
+	Qty         int          `json:"qty"`
+	Maturity    int          `json:"maturity"`
+	Type        string       `json:"type,omitempty"`
+	CouponRate  Rate         `json:"couponRate,omitempty"`
+	DayCount    string       `json:"dayCount,omitempty"`
+	Program     string       `json:"program,omitempty"`
+	Currency    string       `json:"currency,omitempty"`
+	MaxDiscount *Rate        `json:"maxDiscount,omitempty"`
+	CloseTime   string       `json:"closeTime"`
+	Status      string       `json:"status"`
+	Seq         int          `json:"seq"`
+	Bids        []AuctionBid `json:"bids"`
+	Clearing    Rate         `json:"clearingDiscount,omitempty"`
+	Allocated   int          `json:"allocated,omitempty"`
+	CUSIP       string       `json:"cusip,omitempty"`
+	Timestamp   string       `json:"timestamp"`
+}
+
+func GetAuction(auctionID string, stub shim.ChaincodeStubInterface) (Auction, error) {
+	var auction Auction
+
+	auctionBytes, err := stub.GetState(auctionPrefix + auctionID)
+	if err != nil || auctionBytes == nil {
+		fmt.Println("Auction not found " + auctionID)
+		return auction, errors.New("Auction not found " + auctionID)
+	}
+
+	err = json.Unmarshal(auctionBytes, &auction)
+	if err != nil {
+		fmt.Println("Error unmarshalling auction " + auctionID)
+		return auction, errors.New("Error unmarshalling auction " + auctionID)
+	}
+
+	return auction, nil
+}
+
+func putAuction(stub shim.ChaincodeStubInterface, auction Auction) error {
+	auctionBytes, err := json.Marshal(&auction)
+	if err != nil {
+		fmt.Println("Error marshalling auction " + auction.ID)
+		return errors.New("Error marshalling auction " + auction.ID)
+	}
+	err = stub.PutState(auctionPrefix + auction.ID, auctionBytes)
+	if err != nil {
+		fmt.Println("Error writing auction " + auction.ID + " back")
+		return errors.New("Error writing auction " + auction.ID + " back")
+	}
+
+	return nil
+}
+
+// auctionPaper returns the paper the auction issues on the given date at the
+// given discount
+func auctionPaper(auction Auction, issueDate time.Time, discount Rate) CP {
+	return CP{
+		Ticker:     auction.Ticker,
+		Par:        auction.Par,
+		Qty:        auction.Qty,
+		Discount:   discount,
+		Maturity:   auction.Maturity,
+		Type:       auction.Type,
+		CouponRate: auction.CouponRate,
+		DayCount:   auction.DayCount,
+		Program:    auction.Program,
+		Currency:   auction.Currency,
+		Issuer:     auction.Issuer,
+		IssueDate:  timeToMs(issueDate),
+	}
+}
+
+// sealAuction hides the bids of an open auction from everyone but the
+// bidder that placed them
+func sealAuction(auction *Auction, company string) {
+	if auction.Status != auctionOpen {
+		return
+	}
+	bids := []AuctionBid{}
+	for _, bid := range auction.Bids {
+		if company != "" && bid.Company == company {
+			bids = append(bids, bid)
+		}
+	}
+	auction.Bids = bids
+}
+
+// clearAuction works out the clearing discount and the quantity allocated
+// to each bid. Bids are filled from the lowest discount up until the
+// quantity runs out. Bids at the clearing discount share what is left pro
+// rata to their size, with any odd unit going to the earlier bid. Dropped
+// bids are left out.
+func clearAuction(bids []AuctionBid, quantity int) (Rate, []int) {
+	allocated := make([]int, len(bids))
+
+	// Bid indexes by discount, then by arrival
+	var order []int
+	for i, bid := range bids {
+		if bid.Status == bidDropped {
+			continue
+		}
+		j := len(order)
+		for j > 0 && (bids[order[j - 1]].Discount > bid.Discount || (bids[order[j - 1]].Discount == bid.Discount && bids[order[j - 1]].Seq > bid.Seq)) {
+			j--
+		}
+		order = append(order, 0)
+		copy(order[j + 1:], order[j:])
+		order[j] = i
+	}
+
+	var clearing Rate
+	remaining := quantity
+	for start := 0; start < len(order) && remaining > 0; {
+		// The bids at this discount
+		end := start
+		wanted := 0
+		for end < len(order) && bids[order[end]].Discount == bids[order[start]].Discount {
+			wanted += bids[order[end]].Quantity
+			end++
+		}
+		clearing = bids[order[start]].Discount
+
+		if wanted <= remaining {
+			for _, i := range order[start:end] {
+				allocated[i] = bids[i].Quantity
+			}
+			remaining -= wanted
+		} else {
+			weights := make([]int, end - start)
+			for k, i := range order[start:end] {
+				weights[k] = bids[i].Quantity
+			}
+			for k, share := range allocateProRata(remaining, weights) {
+				allocated[order[start + k]] = share
+			}
+			remaining = 0
+		}
+		start = end
+	}
+
+	return clearing, allocated
+}
+
+func (t *SimpleChaincode) openAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Opening auction")
+	/*		0
+		json
+	  	{
+			"ticker":  "string",
+			"par": 0.00,
+			"qty": 10,
+			"maturity": 30,
+			"type": "discount",  (or "interest", not required)
+			"couponRate": 7.5,   (required for "interest" only)
+			"dayCount": "ACT/360", (or "ACT/365" or "30/360", not required)
+			"program": "string", (required if the issuer has issuance programs)
+			"currency": "USD", (not required)
+			"maxDiscount": 8.0, (highest discount the issuer accepts, not required)
+			"closeTime":"1456161763790"  (time in milliseconds bidding closes)
+		}
+	*/
+	// The issuer is the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting auction")
+	}
+
+	var auction Auction
+	err := json.Unmarshal([]byte(args[0]), &auction)
+	if err != nil {
+		fmt.Println("Error unmarshalling auction")
+		return nil, errors.New("Invalid auction")
+	}
+	auction.Issuer, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	switch auction.Type {
+	case "", discountPaper:
+		auction.Type = discountPaper
+		if auction.CouponRate != 0 {
+			return nil, errors.New("Discount paper can't have a coupon rate")
+		}
+	case interestPaper:
+		if auction.CouponRate <= 0 {
+			return nil, errors.New("Interest-bearing paper needs a positive coupon rate")
+		}
+	default:
+		return nil, errors.New("Unknown paper type " + auction.Type)
+	}
+	switch auction.DayCount {
+	case "":
+		auction.DayCount = act360
+	case act360, act365, thirty360:
+	default:
+		return nil, errors.New("Unknown day count convention " + auction.DayCount)
+	}
+	if auction.Currency == "" {
+		auction.Currency = defaultCurrency
+	}
+	if !validCurrency(auction.Currency) {
+		return nil, errors.New("Invalid currency " + auction.Currency)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	closeTime, err := msToTime(auction.CloseTime)
+	if err != nil {
+		return nil, errors.New("Invalid auction close time " + auction.CloseTime)
+	}
+	if !closeTime.After(now) {
+		return nil, errors.New("Auction close time must be in the future")
+	}
+
+	// Check the terms as they would be issued today at the lowest discount
+	// allowed, the discount itself is set by the bids
+	limits, err := GetIssuanceLimits(stub)
+	if err != nil {
+		return nil, err
+	}
+	if auction.MaxDiscount != nil && (*auction.MaxDiscount < limits.MinDiscount || *auction.MaxDiscount > limits.MaxDiscount) {
+		return nil, errors.New("Maximum discount must be between " + limits.MinDiscount.String() + "% and " + limits.MaxDiscount.String() + "%")
+	}
+	err = validateIssue(auctionPaper(auction, now, limits.MinDiscount), limits, now)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := GetCompany(auction.Issuer, stub)
+	if err != nil {
+		return nil, err
+	}
+	if issuer.Defaulted {
+		fmt.Println("The issuer " + auction.Issuer + " is in default")
+		return nil, errors.New("The issuer " + auction.Issuer + " is in default and can't issue paper")
+	}
+
+	auction.ID = stub.GetTxID()
+	auction.CloseTime = timeToMs(closeTime)
+	auction.Status = auctionOpen
+	auction.Seq = 0
+	auction.Bids = []AuctionBid{}
+	auction.Clearing = 0
+	auction.Allocated = 0
+	auction.CUSIP = ""
+	auction.Timestamp = timeToMs(now)
+
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Opened auction " + auction.ID)
+	return []byte(auction.ID), nil
+}
+
+func (t *SimpleChaincode) submitBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Submitting auction bid")
+	/*		0
+		json
+	  	{
+			"auction": "auction ID",
+			"quantity": 5,
+			"discount": 7.5
+		}
+	*/
+	// The bidder is the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting bid")
+	}
+
+	var request struct {
+		Auction  string `json:"auction"`
+		Quantity int    `json:"quantity"`
+		Discount Rate   `json:"discount"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		fmt.Println("Error unmarshalling bid")
+		return nil, errors.New("Invalid bid")
+	}
+	bidder, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	auction, err := GetAuction(request.Auction, stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	closeTime, err := msToTime(auction.CloseTime)
+	if err != nil {
+		return nil, errors.New("Invalid close time on auction " + auction.ID)
+	}
+	if auction.Status != auctionOpen || !now.Before(closeTime) {
+		fmt.Println("Auction " + auction.ID + " is closed for bids")
+		return nil, errors.New("Auction " + auction.ID + " is closed for bids")
+	}
+
+	if bidder == auction.Issuer {
+		return nil, errors.New("The issuer " + auction.Issuer + " can't bid for its own paper")
+	}
+	if request.Quantity <= 0 || request.Quantity > auction.Qty {
+		return nil, errors.New("Bid quantity must be between 1 and " + strconv.Itoa(auction.Qty))
+	}
+	limits, err := GetIssuanceLimits(stub)
+	if err != nil {
+		return nil, err
+	}
+	if request.Discount < limits.MinDiscount || request.Discount > limits.MaxDiscount {
+		return nil, errors.New("Bid discount must be between " + limits.MinDiscount.String() + "% and " + limits.MaxDiscount.String() + "%")
+	}
+	if auction.MaxDiscount != nil && request.Discount > *auction.MaxDiscount {
+		return nil, errors.New("Bid discount is above the issuer's maximum of " + auction.MaxDiscount.String() + "%")
+	}
+	// A zero discount on a note would be read as issuing at the coupon rate
+	if auction.Type == interestPaper && request.Discount <= 0 {
+		return nil, errors.New("Bids on interest-bearing paper need a positive discount")
+	}
+
+	// The company's bids must be covered by its cash, each at its own
+	// discount, which is the most it can pay at any clearing discount
+	company, err := GetCompany(bidder, stub)
+	if err != nil {
+		return nil, err
+	}
+	bid := AuctionBid{
+		ID:        stub.GetTxID(),
+		Company:   bidder,
+		Quantity:  request.Quantity,
+		Discount:  request.Discount,
+		Seq:       auction.Seq + 1,
+		Status:    bidSubmitted,
+		Timestamp: timeToMs(now),
+	}
+	var committed Money
+	for _, other := range append(auction.Bids, bid) {
+		if other.Company != bidder {
+			continue
+		}
+		amount, err := paperPrice(auctionPaper(auction, closeTime, 0), other.Quantity, other.Discount, closeTime)
+		if err != nil {
+			return nil, err
+		}
+		committed += amount
+	}
+	if availableCash(company, auction.Currency, now) < committed {
+		fmt.Println("The company " + bidder + " doesn't have enough cash for its bids")
+		return nil, errors.New("The company " + bidder + " doesn't have enough " + auction.Currency + " cash to cover its bids of " + committed.String())
+	}
+
+	auction.Seq = bid.Seq
+	auction.Bids = append(auction.Bids, bid)
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Submitted bid " + bid.ID + " on auction " + auction.ID)
+	return []byte(bid.ID), nil
+}
+
+func (t *SimpleChaincode) closeAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Closing auction")
+	/*		0
+		auction ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting auction ID")
+	}
+
+	auction, err := GetAuction(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != auctionOpen {
+		fmt.Println("Auction " + auction.ID + " is " + auction.Status)
+		return nil, errors.New("Auction " + auction.ID + " is " + auction.Status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	closeTime, err := msToTime(auction.CloseTime)
+	if err != nil {
+		return nil, errors.New("Invalid close time on auction " + auction.ID)
+	}
+	if now.Before(closeTime) {
+		return nil, errors.New("Auction " + auction.ID + " doesn't close until " + closeTime.UTC().Format(time.RFC3339))
+	}
+
+	// Settlement is on the close date. Bidders who can no longer pay for
+	// what they win are dropped and the auction is cleared again without
+	// them, until every winner can pay.
+	issueDate := now.Truncate(time.Millisecond)
+	var clearing Rate
+	var allocated []int
+	for {
+		clearing, allocated = clearAuction(auction.Bids, auction.Qty)
+		won := make(map[string]int)
+		for i, bid := range auction.Bids {
+			won[bid.Company] += allocated[i]
+		}
+
+		dropped := false
+		for i, bid := range auction.Bids {
+			if allocated[i] == 0 || bid.Status == bidDropped {
+				continue
+			}
+			company, err := GetCompany(bid.Company, stub)
+			if err != nil {
+				return nil, err
+			}
+			amount, err := paperPrice(auctionPaper(auction, issueDate, clearing), won[bid.Company], clearing, issueDate)
+			if err != nil {
+				return nil, err
+			}
+			if availableCash(company, auction.Currency, now) < amount {
+				fmt.Println("Dropping bid " + bid.ID + " from " + bid.Company + " that can't pay")
+				auction.Bids[i].Status = bidDropped
+				dropped = true
+			}
+		}
+		if !dropped {
+			break
+		}
+	}
+
+	var allocations []Owner
+	auction.Allocated = 0
+	for i, bid := range auction.Bids {
+		if bid.Status == bidDropped {
+			continue
+		}
+		auction.Bids[i].Allocated = allocated[i]
+		if allocated[i] == 0 {
+			auction.Bids[i].Status = bidUnallocated
+			continue
+		}
+		auction.Bids[i].Status = bidAllocated
+		auction.Allocated += allocated[i]
+		allocations = append(allocations, Owner{Company: bid.Company, Quantity: allocated[i]})
+	}
+	auction.Status = auctionClosed
+
+	// Only what was sold is issued, through the normal issuance path so the
+	// issuance rules, programs and fees all apply. The winners are its
+	// primary allocations and pay the issuer for them.
+	if auction.Allocated > 0 {
+		auction.Clearing = clearing
+		cp := auctionPaper(auction, issueDate, clearing)
+		cp.Qty = auction.Allocated
+		issuance := struct {
+			CP
+			Owners []Owner `json:"owners"`
+		}{cp, allocations}
+		cpBytes, err := json.Marshal(&issuance)
+		if err != nil {
+			fmt.Println("Error marshalling auction paper")
+			return nil, errors.New("Error marshalling auction paper")
+		}
+		_, err = t.issueCommercialPaper(stub, []string{string(cpBytes)})
+		if err != nil {
+			return nil, err
+		}
+
+		issuer, err := GetCompany(auction.Issuer, stub)
+		if err != nil {
+			return nil, err
+		}
+		suffix, err := generateCUSIPSuffix(cp.IssueDate, cp.Maturity)
+		if err != nil {
+			return nil, err
+		}
+		auction.CUSIP = issuer.Prefix + suffix
+	}
+
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Closed auction %s, %d allocated at %s\n", auction.ID, auction.Allocated, auction.Clearing)
+	return json.Marshal(&auction)
+}
+
+func (t *SimpleChaincode) cancelAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Cancelling auction")
+	/*		0
+		auction ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting auction ID")
+	}
+
+	// Only the issuer can cancel its auction
+	issuer, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	auction, err := GetAuction(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Issuer != issuer {
+		fmt.Println("Auction " + auction.ID + " doesn't belong to " + issuer)
+		return nil, errors.New("Auction " + auction.ID + " doesn't belong to " + issuer)
+	}
+	if auction.Status != auctionOpen {
+		fmt.Println("Auction " + auction.ID + " is " + auction.Status)
+		return nil, errors.New("Auction " + auction.ID + " is " + auction.Status)
+	}
+
+	auction.Status = auctionCancelled
+	err = putAuction(stub, auction)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Cancelled auction " + auction.ID)
+	return nil, nil
+}
+
+// GetAuctions returns the auctions that are open for bids. Bids are sealed,
+// so only those of the given company are shown.
+func GetAuctions(companyID string, stub shim.ChaincodeStubInterface) ([]Auction, error) {
+	auctions := []Auction{}
+
+	iter, err := stub.RangeQueryState(auctionPrefix, auctionPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading auctions")
+		return nil, errors.New("Error reading auctions: " + err.Error())
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		key, auctionBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading auctions: " + err.Error())
+		}
+		var auction Auction
+		err = json.Unmarshal(auctionBytes, &auction)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		if auction.Status != auctionOpen {
+			continue
+		}
+		sealAuction(&auction, companyID)
+		auctions = append(auctions, auction)
+	}
+
+	return auctions, nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCloseAuction(t *testing.T) {
+	cc, stub := newTestStub(t)
+
+	auctionID := string(mustInvoke(t, stub, cc, "company1", "openAuction", toJSON(t, map[string]interface{}{
+		"ticker":    "ABC",
+		"par":       1000.00,
+		"qty":       10,
+		"maturity":  30,
+		"closeTime": ms(stub.now.Add(time.Hour)),
+	})))
+	bids := []struct {
+		company  string
+		quantity int
+		discount float64
+	}{
+		{"company2", 6, 3.4},
+		{"company3", 6, 3.5},
+		{"company4", 5, 3.6},
+	}
+	for _, bid := range bids {
+		mustInvoke(t, stub, cc, bid.company, "submitBid", toJSON(t, map[string]interface{}{
+			"auction":  auctionID,
+			"quantity": bid.quantity,
+			"discount": bid.discount,
+		}))
+	}
+
+	stub.now = stub.now.Add(2 * time.Hour)
+	var auction Auction
+	err := json.Unmarshal(mustInvoke(t, stub, cc, "company5", "closeAuction", auctionID), &auction)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// company2 is filled in full, company3 gets what is left at the
+	// clearing discount and company4 bid above it
+	if auction.Clearing != 3500000 || auction.Allocated != 10 {
+		t.Fatalf("cleared %d at %s, want 10 at 3.5", auction.Allocated, auction.Clearing)
+	}
+	expectHoldings(t, stub, auction.CUSIP, map[string]int{
+		"company1": 0,
+		"company2": 6,
+		"company3": 4,
+		"company4": 0,
+	})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 598250 + 398833,
+		"company2": initialCashBalance - 598250,
+		"company3": initialCashBalance - 398833,
+		"company4": initialCashBalance,
+	})
+}
+
+func TestAuctionBidsAreSealed(t *testing.T) {
+	cc, stub := newTestStub(t)
+
+	auctionID := string(mustInvoke(t, stub, cc, "company1", "openAuction", toJSON(t, map[string]interface{}{
+		"ticker":    "ABC",
+		"par":       1000.00,
+		"qty":       10,
+		"maturity":  30,
+		"closeTime": ms(stub.now.Add(time.Hour)),
+	})))
+	for _, bidder := range []string{"company2", "company3"} {
+		mustInvoke(t, stub, cc, bidder, "submitBid", toJSON(t, map[string]interface{}{
+			"auction":  auctionID,
+			"quantity": 5,
+			"discount": 3.5,
+		}))
+	}
+
+	// Each bidder only sees its own bid, anyone else sees none
+	for _, test := range []struct {
+		caller string
+		bids   int
+	}{
+		{"company2", 1},
+		{"company3", 1},
+		{"company4", 0},
+		{"", 0},
+	} {
+		var auction Auction
+		result, err := query(stub, cc, test.caller, "GetAuction", auctionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(result, &auction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(auction.Bids) != test.bids {
+			t.Errorf("%q sees %d bids, want %d", test.caller, len(auction.Bids), test.bids)
+		}
+		for _, bid := range auction.Bids {
+			if bid.Company != test.caller {
+				t.Errorf("%q sees the bid of %s", test.caller, bid.Company)
+			}
+		}
+	}
+	_, err := query(stub, cc, "company4", "GetState", auctionPrefix + auctionID)
+	if err == nil {
+		t.Error("the auction could be read directly from state")
+	}
+
+	// Only the issuer can cancel
+	_, err = invoke(stub, cc, "company2", "cancelAuction", auctionID)
+	if err == nil {
+		t.Error("a bidder cancelled the auction")
+	}
+	mustInvoke(t, stub, cc, "company1", "cancelAuction", auctionID)
+}
@@ -0,0 +1,490 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var batchPrefix = "batch:"
+
+// Batch is a set of transfers that settle together or not at all. Like a
+// single transfer it is proposed first, and it settles once every buyer in
+// it has accepted. Batches use the proposal status values and expiry.
+type Batch struct {
+	ID        string        `json:"id"`
+	Transfers []Transaction `json:"transfers"`
+	Accepted  []string      `json:"accepted"`
+	Status    string        `json:"status"`
+	Timestamp string        `json:"timestamp"`
+	Expiry    string        `json:"expiry"`
+	TradeIDs  []string      `json:"tradeIds,omitempty"`
+}
+
+// batchLedger holds the papers and accounts a batch touches while its legs
+// are worked through, so each leg sees what the earlier ones did. Records
+// are kept in the order they were first loaded so they are written back in
+// a fixed order.
+type batchLedger struct {
+	stub     shim.ChaincodeStubInterface
+	cps      map[string]*CP
+	accounts map[string]*Account
+	cpOrder  []string
+	idOrder  []string
+	trades   []Trade
+	fees     []FeeRecord
+}
+
+func newBatchLedger(stub shim.ChaincodeStubInterface) *batchLedger {
+	return &batchLedger{stub: stub, cps: make(map[string]*CP), accounts: make(map[string]*Account)}
+}
+
+func (l *batchLedger) paper(cusip string) (*CP, error) {
+	if cp, ok := l.cps[cusip]; ok {
+		return cp, nil
+	}
+	cp, err := GetCP(cpPrefix + cusip, l.stub)
+	if err != nil {
+		return nil, err
+	}
+	l.cps[cusip] = &cp
+	l.cpOrder = append(l.cpOrder, cusip)
+	return &cp, nil
+}
+
+func (l *batchLedger) account(companyID string) (*Account, error) {
+	if account, ok := l.accounts[companyID]; ok {
+		return account, nil
+	}
+	account, err := GetCompany(companyID, l.stub)
+	if err != nil {
+		return nil, err
+	}
+	l.accounts[companyID] = &account
+	l.idOrder = append(l.idOrder, companyID)
+	return &account, nil
+}
+
+// transfer settles one leg against the ledger, including the transfer fee
+func (l *batchLedger) transfer(tr Transaction, tradeID string, schedule FeeSchedule, now time.Time) error {
+	if tr.FromCompany == tr.ToCompany {
+		return errors.New("The company " + tr.FromCompany + " can't transfer paper to itself")
+	}
+	cp, err := l.paper(tr.CUSIP)
+	if err != nil {
+		return err
+	}
+	fromCompany, err := l.account(tr.FromCompany)
+	if err != nil {
+		return err
+	}
+	toCompany, err := l.account(tr.ToCompany)
+	if err != nil {
+		return err
+	}
+
+	trade, err := executeTransfer(cp, fromCompany, toCompany, tr, now)
+	if err != nil {
+		return err
+	}
+	trade.ID = tradeID
+	fromCompany.TradeIds = append(fromCompany.TradeIds, trade.ID)
+	toCompany.TradeIds = append(toCompany.TradeIds, trade.ID)
+
+	trade.Fee = schedule.Transfer.amount(trade.Amount)
+	if trade.Fee != 0 {
+		operator, err := l.account(schedule.Operator)
+		if err != nil {
+			return err
+		}
+		record := FeeRecord{
+			ID:        trade.ID,
+			Kind:      transferFee,
+			Payer:     trade.FromCompany,
+			CUSIP:     trade.CUSIP,
+			Currency:  trade.Currency,
+			Basis:     trade.Amount,
+			Amount:    trade.Fee,
+			Operator:  schedule.Operator,
+			Timestamp: trade.Timestamp,
+		}
+		err = takeFee(record, fromCompany, operator)
+		if err != nil {
+			return err
+		}
+		l.fees = append(l.fees, record)
+	}
+
+	l.trades = append(l.trades, trade)
+	return nil
+}
+
+// write puts every paper, account, trade and fee the ledger holds
+func (l *batchLedger) write() error {
+	for _, companyID := range l.idOrder {
+		err := putCompany(l.stub, *l.accounts[companyID])
+		if err != nil {
+			return err
+		}
+	}
+	for _, cusip := range l.cpOrder {
+		err := putCP(l.stub, *l.cps[cusip])
+		if err != nil {
+			return err
+		}
+	}
+	for _, trade := range l.trades {
+		err := putTrade(l.stub, trade)
+		if err != nil {
+			return err
+		}
+		err = markHoldsConsumed(l.stub, trade.Holds, trade.ID, trade.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	for _, record := range l.fees {
+		err := putFeeRecord(l.stub, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBatch works every leg through a fresh ledger in order and returns the
+// ledger if they all settle. The error names the first leg that fails.
+// Nothing is written.
+func runBatch(stub shim.ChaincodeStubInterface, transfers []Transaction, tradePrefix string, now time.Time) (*batchLedger, error) {
+	schedule, err := GetFeeSchedule(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := newBatchLedger(stub)
+	for i, tr := range transfers {
+		leg := strconv.Itoa(i + 1)
+		err = ledger.transfer(tr, tradePrefix + "-" + leg, schedule, now)
+		if err != nil {
+			fmt.Println("Batch leg " + leg + " failed: " + err.Error())
+			return nil, errors.New("leg " + leg + ": " + err.Error())
+		}
+	}
+
+	return ledger, nil
+}
+
+// batchBuyers returns each company buying in the batch once
+func batchBuyers(batch Batch) []string {
+	var buyers []string
+	for _, tr := range batch.Transfers {
+		found := false
+		for _, buyer := range buyers {
+			if buyer == tr.ToCompany {
+				found = true
+			}
+		}
+		if !found {
+			buyers = append(buyers, tr.ToCompany)
+		}
+	}
+	return buyers
+}
+
+func GetBatch(batchID string, stub shim.ChaincodeStubInterface) (Batch, error) {
+	var batch Batch
+
+	batchBytes, err := stub.GetState(batchPrefix + batchID)
+	if err != nil || batchBytes == nil {
+		fmt.Println("Batch not found " + batchID)
+		return batch, errors.New("Batch not found " + batchID)
+	}
+
+	err = json.Unmarshal(batchBytes, &batch)
+	if err != nil {
+		fmt.Println("Error unmarshalling batch " + batchID)
+		return batch, errors.New("Error unmarshalling batch " + batchID)
+	}
+
+	return batch, nil
+}
+
+func putBatch(stub shim.ChaincodeStubInterface, batch Batch) error {
+	batchBytes, err := json.Marshal(&batch)
+	if err != nil {
+		fmt.Println("Error marshalling batch " + batch.ID)
+		return errors.New("Error marshalling batch " + batch.ID)
+	}
+	err = stub.PutState(batchPrefix + batch.ID, batchBytes)
+	if err != nil {
+		fmt.Println("Error writing batch " + batch.ID + " back")
+		return errors.New("Error writing batch " + batch.ID + " back")
+	}
+
+	return nil
+}
+
+// expireBatch marks a pending batch expired once its expiry has passed
+func expireBatch(batch *Batch, now time.Time) {
+	if batch.Status == proposalPending && pastExpiry(batch.Expiry, now) {
+		batch.Status = proposalExpired
+	}
+}
+
+func (t *SimpleChaincode) batchTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Proposing batch transfer")
+	/*		0
+		json
+	  	{
+			"transfers": [
+				{
+					"cusip": "",
+					"fromCompany": "company1",  (the caller's account)
+					"toCompany": "company2",
+					"quantity": 1,
+					"discount": 7.5  (not required)
+				}
+			]
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting batch of transfers")
+	}
+
+	var batch Batch
+	err := json.Unmarshal([]byte(args[0]), &batch)
+	if err != nil {
+		fmt.Println("Error unmarshalling batch")
+		return nil, errors.New("Invalid batch of transfers")
+	}
+	if len(batch.Transfers) == 0 {
+		return nil, errors.New("A batch needs at least one transfer")
+	}
+	// The caller can only sell its own paper, the buyers each accept
+	seller, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	for i, tr := range batch.Transfers {
+		if tr.Net {
+			return nil, errors.New("Leg " + strconv.Itoa(i + 1) + " is marked for net settlement, a batch settles on its own")
+		}
+		if tr.FromCompany != seller {
+			fmt.Println("The company " + seller + " can't propose a transfer of " + tr.FromCompany + "'s paper")
+			return nil, errors.New("Leg " + strconv.Itoa(i + 1) + " sells " + tr.FromCompany + "'s paper, the company " + seller + " can only sell its own")
+		}
+	}
+
+	// Every leg has to settle against the state as it stands, each seeing
+	// the earlier legs, before the batch is offered to the buyers
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	_, err = runBatch(stub, batch.Transfers, stub.GetTxID(), now)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := GetProposalSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	batch.ID = stub.GetTxID()
+	batch.Accepted = []string{}
+	batch.Status = proposalPending
+	batch.Timestamp = timeToMs(now)
+	batch.Expiry = timeToMs(now.Add(time.Duration(settings.ExpiryMinutes) * time.Minute))
+	batch.TradeIDs = nil
+	err = putBatch(stub, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Proposed batch %s of %d transfers\n", batch.ID, len(batch.Transfers))
+	return json.Marshal(&batch)
+}
+
+// answerBatch loads a batch the caller is buying in that is still pending
+// on the given date, along with the buyer named in the caller's certificate
+func answerBatch(stub shim.ChaincodeStubInterface, batchID string, now time.Time) (Batch, string, error) {
+	batch, err := GetBatch(batchID, stub)
+	if err != nil {
+		return batch, "", err
+	}
+	buyer, err := callerCompany(stub)
+	if err != nil {
+		return batch, "", err
+	}
+	buying := false
+	for _, company := range batchBuyers(batch) {
+		if company == buyer {
+			buying = true
+		}
+	}
+	if !buying {
+		fmt.Println("The company " + buyer + " isn't buying in batch " + batchID)
+		return batch, buyer, errors.New("The company " + buyer + " isn't buying in batch " + batchID)
+	}
+	expireBatch(&batch, now)
+	if batch.Status != proposalPending {
+		fmt.Println("Batch " + batchID + " is " + batch.Status)
+		return batch, buyer, errors.New("Batch " + batchID + " is " + batch.Status)
+	}
+
+	return batch, buyer, nil
+}
+
+func (t *SimpleChaincode) acceptBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting batch transfer")
+	/*		0
+		batch ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting batch ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	batch, buyer, err := answerBatch(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+	for _, company := range batch.Accepted {
+		if company == buyer {
+			return nil, errors.New("The company " + buyer + " has already accepted batch " + batch.ID)
+		}
+	}
+	batch.Accepted = append(batch.Accepted, buyer)
+
+	// The last buyer to accept settles the whole batch. The legs are worked
+	// through again against the state now, and nothing is written unless
+	// they all settle.
+	if len(batch.Accepted) == len(batchBuyers(batch)) {
+		ledger, err := runBatch(stub, batch.Transfers, stub.GetTxID(), now)
+		if err != nil {
+			return nil, err
+		}
+		err = ledger.write()
+		if err != nil {
+			return nil, err
+		}
+		batch.Status = proposalAccepted
+		for _, trade := range ledger.trades {
+			batch.TradeIDs = append(batch.TradeIDs, trade.ID)
+		}
+		fmt.Println("Settled batch " + batch.ID)
+	}
+
+	err = putBatch(stub, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Accepted batch " + batch.ID + " for " + buyer)
+	return json.Marshal(&batch)
+}
+
+func (t *SimpleChaincode) rejectBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Rejecting batch transfer")
+	/*		0
+		batch ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting batch ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	batch, _, err := answerBatch(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	batch.Status = proposalRejected
+	err = putBatch(stub, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rejected batch " + batch.ID)
+	return nil, nil
+}
+
+// GetBatches returns the batches the company buys or sells in, only pending
+// ones unless all is set
+func GetBatches(companyID string, all bool, stub shim.ChaincodeStubInterface) ([]Batch, error) {
+	batches := []Batch{}
+
+	iter, err := stub.RangeQueryState(batchPrefix, batchPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading batches")
+		return nil, errors.New("Error reading batches: " + err.Error())
+	}
+	defer iter.Close()
+
+	now, timeErr := txTime(stub)
+	for iter.HasNext() {
+		key, batchBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading batches: " + err.Error())
+		}
+		var batch Batch
+		err = json.Unmarshal(batchBytes, &batch)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+
+		involved := false
+		for _, tr := range batch.Transfers {
+			if tr.FromCompany == companyID || tr.ToCompany == companyID {
+				involved = true
+			}
+		}
+		if !involved {
+			continue
+		}
+		if timeErr == nil {
+			expireBatch(&batch, now)
+		}
+		if !all && batch.Status != proposalPending {
+			continue
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
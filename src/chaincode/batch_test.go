@@ -0,0 +1,66 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBatchSettlesOnLastAcceptance(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	batchJSON := toJSON(t, map[string]interface{}{
+		"transfers": []map[string]interface{}{
+			{"cusip": cusip, "fromCompany": "company1", "toCompany": "company2", "quantity": 2},
+			{"cusip": cusip, "fromCompany": "company1", "toCompany": "company3", "quantity": 3},
+		},
+	})
+
+	// Only the seller can propose the batch
+	for _, caller := range []string{"company2", "company4", ""} {
+		_, err := invoke(stub, cc, caller, "batchTransfer", batchJSON)
+		if err == nil {
+			t.Errorf("%q proposed a batch selling company1's paper", caller)
+		}
+	}
+	var batch Batch
+	err := json.Unmarshal(mustInvoke(t, stub, cc, "company1", "batchTransfer", batchJSON), &batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the buyers can accept, and nothing settles until both have
+	for _, caller := range []string{"company1", "company4", ""} {
+		_, err := invoke(stub, cc, caller, "acceptBatch", batch.ID)
+		if err == nil {
+			t.Errorf("%q accepted a batch it isn't buying in", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptBatch", batch.ID)
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 10, "company2": 0, "company3": 0})
+	mustInvoke(t, stub, cc, "company3", "acceptBatch", batch.ID)
+
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 5, "company2": 2, "company3": 3})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 199400 + 299100,
+		"company2": initialCashBalance - 199400,
+		"company3": initialCashBalance - 299100,
+	})
+}
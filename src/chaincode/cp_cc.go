@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"strconv"
 	"time"
 	"strings"
@@ -31,6 +32,35 @@ import (
 
 var cpPrefix = "cp:"
 var accountPrefix = "acct:"
+var tradePrefix = "trade:"
+
+// Every new account starts with the same cash balance
+var initialCashBalance = Money(10000000 * moneyScale)
+
+// Paper status values. Papers written before status existed have an empty
+// status and are treated as active.
+const (
+	paperActive    = "active"
+	paperMatured   = "matured"
+	paperDefaulted = "defaulted"
+)
+
+// Instrument types. Discount paper is sold below par and pays par at
+// maturity, interest-bearing notes pay par plus a coupon at maturity. Papers
+// written before types existed have an empty type and are discount paper.
+const (
+	discountPaper = "discount"
+	interestPaper = "interest"
+)
+
+// Day count conventions used to turn a period into a fraction of a year.
+// Papers written before conventions existed have an empty convention and use
+// ACT/360.
+const (
+	act360    = "ACT/360"
+	act365    = "ACT/365"
+	thirty360 = "30/360"
+)
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
@@ -38,6 +68,14 @@ type SimpleChaincode struct {
 
 func generateCUSIPSuffix(issueDate string, days int) (string, error) {
 
+	// The suffix encodes the maturity date's month, day and the last digit
+	// of its year, so it only comes up again for paper maturing on the same
+	// day ten years apart. Paper is only added to an existing CUSIP on
+	// matching terms and issue date, so a clash fails the issue.
+	if days < minMaturityDays || days > maxMaturityDays {
+		return "", errMaturityRange
+	}
+
 	t, err := msToTime(issueDate)
 	if err != nil {
 		return "", err
@@ -47,7 +85,9 @@ func generateCUSIPSuffix(issueDate string, days int) (string, error) {
 	month := int(maturityDate.Month())
 	day := maturityDate.Day()
 
-	suffix := seventhDigit[month] + eigthDigit[day]
+	year := maturityDate.Year() % 10
+
+	suffix := seventhDigit[month] + eigthDigit[day] + strconv.Itoa(year)
 	return suffix, nil
 
 }
@@ -67,28 +107,278 @@ func msToTime(ms string) (time.Time, error) {
 		(msInt % millisPerSecond) * nanosPerMillisecond), nil
 }
 
+func timeToMs(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano() / nanosPerMillisecond, 10)
+}
+
+// txTime returns the timestamp of the current transaction
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ts == nil {
+		return time.Time{}, errors.New("Transaction timestamp not available")
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos)), nil
+}
+
+// accountAttribute is the transaction certificate attribute that names the
+// account the caller trades for
+var accountAttribute = "account"
+
+// callerCompany returns the account named in the caller's transaction
+// certificate
+func callerCompany(stub shim.ChaincodeStubInterface) (string, error) {
+	account, err := stub.ReadCertAttribute(accountAttribute)
+	if err != nil {
+		fmt.Println("Error reading the caller's account attribute")
+		return "", errors.New("Error reading the caller's " + accountAttribute + " attribute: " + err.Error())
+	}
+	if len(account) == 0 {
+		fmt.Println("The caller's certificate doesn't name an account")
+		return "", errors.New("The caller's certificate doesn't carry an " + accountAttribute + " attribute")
+	}
+
+	return string(account), nil
+}
+
+// roleAttribute is the transaction certificate attribute that carries the
+// caller's role, and adminRole the role that runs the platform
+var roleAttribute = "role"
+var adminRole = "admin"
+
+// requireAdmin fails unless the caller's transaction certificate carries the
+// admin role
+func requireAdmin(stub shim.ChaincodeStubInterface) error {
+	role, err := stub.ReadCertAttribute(roleAttribute)
+	if err != nil {
+		fmt.Println("Error reading the caller's role attribute")
+		return errors.New("Error reading the caller's " + roleAttribute + " attribute: " + err.Error())
+	}
+	if string(role) != adminRole {
+		fmt.Println("The caller isn't an admin")
+		return errors.New("Only an " + adminRole + " can do this")
+	}
+
+	return nil
+}
+
+// maturityDate returns the date on which the paper matures
+func maturityDate(cp CP) (time.Time, error) {
+	t, err := msToTime(cp.IssueDate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return t.AddDate(0, 0, cp.Maturity), nil
+}
+
+// daysToMaturity returns the number of whole days left until the paper
+// matures, or an error if it already has
+func daysToMaturity(cp CP, now time.Time) (int, error) {
+	maturity, err := maturityDate(cp)
+	if err != nil {
+		return 0, err
+	}
+	if !now.Before(maturity) {
+		return 0, errors.New("The paper " + cp.CUSIP + " matured on " + maturity.Format("2006-01-02"))
+	}
+
+	return int(maturity.Sub(now).Hours() / 24), nil
+}
+
+// calendarDaysToMaturity returns the number of calendar days left until the
+// paper matures, the days it is priced over, or an error if it already has
+func calendarDaysToMaturity(cp CP, now time.Time) (int, error) {
+	_, err := daysToMaturity(cp, now)
+	if err != nil {
+		return 0, err
+	}
+	maturity, err := maturityDate(cp)
+	if err != nil {
+		return 0, err
+	}
+
+	return calendarDays(now, maturity), nil
+}
+
+// calendarDays returns the number of calendar days from one date to another
+func calendarDays(from, to time.Time) int {
+	y1, m1, d1 := from.UTC().Date()
+	y2, m2, d2 := to.UTC().Date()
+	days := time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC).Sub(time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC))
+	return int(days.Hours() / 24)
+}
+
+// dayCountFraction returns the exact fraction of a year between two dates
+// under the paper's day count convention
+func dayCountFraction(cp CP, from, to time.Time) *big.Rat {
+	switch cp.DayCount {
+	case act365:
+		return big.NewRat(int64(calendarDays(from, to)), 365)
+	case thirty360:
+		y1, m1, d1 := from.UTC().Date()
+		y2, m2, d2 := to.UTC().Date()
+		if d1 == 31 {
+			d1 = 30
+		}
+		if d2 == 31 && d1 == 30 {
+			d2 = 30
+		}
+		days := 360 * (y2 - y1) + 30 * (int(m2) - int(m1)) + (d2 - d1)
+		return big.NewRat(int64(days), 360)
+	default:
+		return big.NewRat(int64(calendarDays(from, to)), 360)
+	}
+}
+
+// yearFraction returns the fraction of a year between two dates under the
+// paper's day count convention, for reporting only
+func yearFraction(cp CP, from, to time.Time) float64 {
+	fraction, _ := dayCountFraction(cp, from, to).Float64()
+	return fraction
+}
+
+// growth returns 1 + rate * fraction
+func growth(rate Rate, fraction *big.Rat) *big.Rat {
+	r := new(big.Rat).Mul(rate.fraction(), fraction)
+	return r.Add(r, big.NewRat(1, 1))
+}
+
+// maturityValue returns what one unit of the paper pays at maturity,
+// rounded to the cent
+func maturityValue(cp CP) (Money, error) {
+	if cp.Type != interestPaper {
+		return cp.Par, nil
+	}
+
+	issueDate, err := msToTime(cp.IssueDate)
+	if err != nil {
+		return 0, err
+	}
+	maturity, err := maturityDate(cp)
+	if err != nil {
+		return 0, err
+	}
+
+	value := growth(cp.CouponRate, dayCountFraction(cp, issueDate, maturity))
+	return moneyFromRat(value.Mul(value, cp.Par.rat())), nil
+}
+
+// paperPrice returns the cash amount for quantity units of the paper
+// discounted at the given rate from the settlement date to maturity.
+// Discount paper is priced on a bank discount basis, interest-bearing notes
+// discount their maturity value using the rate as a money market yield. The
+// amount is worked out exactly and rounded to the cent once.
+func paperPrice(cp CP, quantity int, discount Rate, settle time.Time) (Money, error) {
+	maturity, err := maturityDate(cp)
+	if err != nil {
+		return 0, err
+	}
+	fraction := dayCountFraction(cp, settle, maturity)
+
+	if cp.Type == interestPaper {
+		value, err := maturityValue(cp)
+		if err != nil {
+			return 0, err
+		}
+		amount := new(big.Rat).Mul(value.rat(), big.NewRat(int64(quantity), 1))
+		return moneyFromRat(amount.Quo(amount, growth(discount, fraction))), nil
+	}
+
+	// quantity * par * (1 - discount * fraction)
+	factor := new(big.Rat).Mul(discount.fraction(), fraction)
+	factor.Sub(big.NewRat(1, 1), factor)
+	amount := new(big.Rat).Mul(cp.Par.rat(), big.NewRat(int64(quantity), 1))
+	return moneyFromRat(amount.Mul(amount, factor)), nil
+}
+
+// allocateProRata splits total units across the given weights. Remainders
+// go to the largest fractional shares first, ties going to the earliest
+// entry, so the result is deterministic.
+func allocateProRata(total int, weights []int) []int {
+	shares := make([]int, len(weights))
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+	if sum == 0 {
+		return shares
+	}
+
+	allocated := 0
+	remainders := make([]int, len(weights))
+	for i, w := range weights {
+		shares[i] = total * w / sum
+		remainders[i] = total * w % sum
+		allocated += shares[i]
+	}
+
+	for allocated < total {
+		best := -1
+		for i := range weights {
+			if weights[i] > 0 && (best == -1 || remainders[i] > remainders[best]) {
+				best = i
+			}
+		}
+		shares[best]++
+		remainders[best] = -1
+		allocated++
+	}
+
+	return shares
+}
+
 type Owner struct {
 	Company  string    `json:"company"`
 	Quantity int      `json:"quantity"`
+	// Encumbered is how much of the quantity is held as repo collateral
+	Encumbered int    `json:"encumbered,omitempty"`
+	// Holds are the active holds on the company's quantity
+	Holds    []HoldEntry `json:"holds,omitempty"`
 }
 
 type CP struct {
 	CUSIP     string  `json:"cusip"`
 	Ticker    string  `json:"ticker"`
-	Par       float64 `json:"par"`
+	Par       Money   `json:"par"`
 	Qty       int     `json:"qty"`
-	Discount  float64 `json:"discount"`
+	Discount  Rate    `json:"discount"`
 	Maturity  int     `json:"maturity"`
+	// Type is discountPaper or interestPaper. CouponRate is the annual
+	// interest rate paid at maturity on interest-bearing notes.
+	Type       string  `json:"type,omitempty"`
+	CouponRate Rate    `json:"couponRate,omitempty"`
+	// DayCount is the day count convention used to price the paper
+	DayCount   string  `json:"dayCount,omitempty"`
+	// Program is the issuance program the paper was issued under, if any
+	Program    string  `json:"program,omitempty"`
+	// Currency is the ISO currency the paper is issued and settled in
+	Currency   string  `json:"currency,omitempty"`
 	Owners    []Owner `json:"owner"`
 	Issuer    string  `json:"issuer"`
 	IssueDate string  `json:"issueDate"`
+	Status    string  `json:"status,omitempty"`
+	// Distressed allows a defaulted paper to keep trading
+	Distressed bool `json:"distressed,omitempty"`
+	// Recovered is the cash per unit paid to holders since a default
+	Recovered Money   `json:"recovered,omitempty"`
 }
 
 type Account struct {
 	ID          string  `json:"id"`
 	Prefix      string  `json:"prefix"`
-	CashBalance float64 `json:"cashBalance"`
+	CashBalance Money   `json:"cashBalance"`
+	// Balances holds cash in currencies other than the default currency
+	Balances    map[string]Money `json:"balances,omitempty"`
 	AssetsIds   []string `json:"assetIds"`
+	Defaulted   bool     `json:"defaulted,omitempty"`
+	Programs    []string `json:"programs,omitempty"`
+	TradeIds    []string `json:"tradeIds,omitempty"`
+	// Holds are the active holds on the account's cash
+	Holds       []HoldEntry `json:"holds,omitempty"`
 }
 
 type Transaction struct {
@@ -96,7 +386,34 @@ type Transaction struct {
 	FromCompany string   `json:"fromCompany"`
 	ToCompany   string   `json:"toCompany"`
 	Quantity    int      `json:"quantity"`
-	Discount    float64  `json:"discount"`
+	Discount    *Rate    `json:"discount,omitempty"`
+	Currency    string   `json:"currency,omitempty"`
+	// Holds are holds the seller placed on the paper or the buyer placed on
+	// cash for this transfer, consumed when it settles
+	Holds       []string `json:"holds,omitempty"`
+	// Net queues the transfer for the next net settlement instead of
+	// settling it on its own
+	Net         bool     `json:"net,omitempty"`
+}
+
+// Trade records a settled transfer at the rate and cash amount it executed at
+type Trade struct {
+	ID          string  `json:"id"`
+	CUSIP       string  `json:"cusip"`
+	FromCompany string  `json:"fromCompany"`
+	ToCompany   string  `json:"toCompany"`
+	Quantity    int     `json:"quantity"`
+	Discount    Rate    `json:"discount"`
+	Amount      Money   `json:"amount"`
+	Currency    string  `json:"currency,omitempty"`
+	// Fee is the operator's fee taken from the seller's proceeds
+	Fee         Money   `json:"fee,omitempty"`
+	Holds       []string `json:"holds,omitempty"`
+	// Reverses is the trade this trade reversed, ReversedBy the trade that
+	// reversed this one
+	Reverses    string  `json:"reverses,omitempty"`
+	ReversedBy  string  `json:"reversedBy,omitempty"`
+	Timestamp   string  `json:"timestamp"`
 }
 
 func (t *SimpleChaincode) createAccounts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
@@ -122,7 +439,7 @@ func (t *SimpleChaincode) createAccounts(stub shim.ChaincodeStubInterface, args
 			prefix = strconv.Itoa(counter) + suffix
 		}
 		var assetIds []string
-		account = Account{ID: "company" + strconv.Itoa(counter), Prefix: prefix, CashBalance: 10000000.0, AssetsIds: assetIds}
+		account = Account{ID: "company" + strconv.Itoa(counter), Prefix: prefix, CashBalance: initialCashBalance, AssetsIds: assetIds}
 		accountBytes, err := json.Marshal(&account)
 		if err != nil {
 			fmt.Println("error creating account" + account.ID)
@@ -152,7 +469,7 @@ func (t *SimpleChaincode) createAccount(stub shim.ChaincodeStubInterface, args [
 	var assetIds []string
 	suffix := "000A"
 	prefix := username + suffix
-	var account = Account{ID: username, Prefix: prefix, CashBalance: 10000000.0, AssetsIds: assetIds}
+	var account = Account{ID: username, Prefix: prefix, CashBalance: initialCashBalance, AssetsIds: assetIds}
 	accountBytes, err := json.Marshal(&account)
 	if err != nil {
 		fmt.Println("error creating account" + account.ID)
@@ -230,7 +547,12 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 			"qty": 10,
 			"discount": 7.5,
 			"maturity": 30,
-			"owners": [ // This one is not required
+			"type": "discount",  (or "interest", not required)
+			"couponRate": 7.5,   (required for "interest" only)
+			"dayCount": "ACT/360", (or "ACT/365" or "30/360", not required)
+			"program": "string", (required if the issuer has issuance programs)
+			"currency": "USD", (ISO currency the paper settles in, not required)
+			"owners": [ // This one is not required, sells quantity to investors at issuance
 				{
 					"company": "company1",
 					"quantity": 5
@@ -245,7 +567,7 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 				}
 			],				
 			"issuer":"company2",
-			"issueDate":"1456161763790"  (current time in milliseconds as a string)
+			"issueDate":"1456161763790"  (current time in milliseconds as a string, no later than the transaction)
 
 		}
 	*/
@@ -266,6 +588,59 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 		return nil, errors.New("Invalid commercial paper issue")
 	}
 
+	switch cp.Type {
+	case "", discountPaper:
+		cp.Type = discountPaper
+		if cp.CouponRate != 0 {
+			fmt.Println("error coupon on discount paper")
+			return nil, errors.New("Discount paper can't have a coupon rate")
+		}
+	case interestPaper:
+		if cp.CouponRate <= 0 {
+			fmt.Println("error missing coupon rate")
+			return nil, errors.New("Interest-bearing paper needs a positive coupon rate")
+		}
+		// Without a market rate the note is issued at par
+		if cp.Discount == 0 {
+			cp.Discount = cp.CouponRate
+		}
+	default:
+		fmt.Println("error unknown paper type " + cp.Type)
+		return nil, errors.New("Unknown paper type " + cp.Type)
+	}
+
+	switch cp.DayCount {
+	case "":
+		cp.DayCount = act360
+	case act360, act365, thirty360:
+	default:
+		fmt.Println("error unknown day count " + cp.DayCount)
+		return nil, errors.New("Unknown day count convention " + cp.DayCount)
+	}
+
+	if cp.Currency == "" {
+		cp.Currency = defaultCurrency
+	}
+	if !validCurrency(cp.Currency) {
+		fmt.Println("error invalid currency " + cp.Currency)
+		return nil, errors.New("Invalid currency " + cp.Currency)
+	}
+
+	limits, err := GetIssuanceLimits(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	err = validateIssue(cp, limits, now)
+	if err != nil {
+		fmt.Println("error invalid paper terms: " + err.Error())
+		return nil, err
+	}
+
 	//generate the CUSIP
 	//get account prefix
 	fmt.Println("Getting state of - " + accountPrefix + cp.Issuer)
@@ -280,14 +655,41 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 		return nil, errors.New("Error retrieving account " + cp.Issuer)
 	}
 
+	if account.Defaulted {
+		fmt.Println("The issuer " + cp.Issuer + " is in default")
+		return nil, errors.New("The issuer " + cp.Issuer + " is in default and can't issue paper")
+	}
+
 	account.AssetsIds = append(account.AssetsIds, cp.CUSIP)
 
+	// Any owners given are investors buying in the primary market, they are
+	// sold their quantity once the paper is issued
+	var issuance struct {
+		Owners []Owner `json:"owners"`
+	}
+	err = json.Unmarshal([]byte(args[0]), &issuance)
+	if err != nil {
+		fmt.Println("Error unmarshalling owners")
+		return nil, errors.New("Invalid owners in commercial paper")
+	}
+	allocations := issuance.Owners
+
 	// Set the issuer to be the owner of all quantity
 	var owner Owner
 	owner.Company = cp.Issuer
 	owner.Quantity = cp.Qty
 
-	cp.Owners = append(cp.Owners, owner)
+	cp.Owners = []Owner{owner}
+
+	// Check the primary sale before anything is written
+	issueDate, err := msToTime(cp.IssueDate)
+	if err != nil {
+		return nil, errIssueDate
+	}
+	sale, err := planPrimarySale(stub, cp, allocations, issueDate)
+	if err != nil {
+		return nil, err
+	}
 
 	suffix, err := generateCUSIPSuffix(cp.IssueDate, cp.Maturity)
 	if err != nil {
@@ -302,6 +704,11 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 	cpRxBytes, err := stub.GetState(cpPrefix + cp.CUSIP)
 	if cpRxBytes == nil {
 		fmt.Println("CUSIP does not exist, creating it")
+		err = drawProgram(stub, cp, account)
+		if err != nil {
+			return nil, err
+		}
+
 		cpBytes, err := json.Marshal(&cp)
 		if err != nil {
 			fmt.Println("Error marshalling cp")
@@ -362,8 +769,12 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 			}
 		}
 
-		fmt.Println("Issue commercial paper %+v\n", cp)
-		return nil, nil
+		fmt.Printf("Issue commercial paper %+v\n", cp)
+		err = settlePrimarySale(stub, cp.CUSIP, sale)
+		if err != nil {
+			return nil, err
+		}
+		return nil, chargeIssuanceFee(stub, cp, now)
 	} else {
 		fmt.Println("CUSIP exists")
 
@@ -375,14 +786,51 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 			return nil, errors.New("Error unmarshalling cp " + cp.CUSIP)
 		}
 
-		cprx.Qty = cprx.Qty + cp.Qty
+		// Only running paper with the same terms, issued on the same day, can
+		// be added to an existing CUSIP
+		if (cprx.Status != "" && cprx.Status != paperActive) || cprx.Distressed {
+			fmt.Println("Existing CUSIP " + cp.CUSIP + " isn't active")
+			return nil, errors.New("The paper " + cp.CUSIP + " is " + cprx.Status + " and can't be added to")
+		}
+		existingIssue, err := msToTime(cprx.IssueDate)
+		if err != nil {
+			return nil, errors.New("Invalid issue date on cp " + cp.CUSIP)
+		}
+		existingType := cprx.Type
+		if existingType == "" {
+			existingType = discountPaper
+		}
+		existingDayCount := cprx.DayCount
+		if existingDayCount == "" {
+			existingDayCount = act360
+		}
+		if existingType != cp.Type || cprx.CouponRate != cp.CouponRate || existingDayCount != cp.DayCount || cprx.Program != cp.Program || paperCurrency(cprx) != cp.Currency ||
+			cprx.Ticker != cp.Ticker || cprx.Par != cp.Par || cprx.Discount != cp.Discount || cprx.Maturity != cp.Maturity || calendarDays(existingIssue, issueDate) != 0 {
+			fmt.Println("Paper terms don't match existing CUSIP " + cp.CUSIP)
+			return nil, errors.New("Paper terms don't match existing CUSIP " + cp.CUSIP)
+		}
 
+		// The new quantity goes to the issuer's entry, which the primary
+		// sale then sells from
+		issuerEntry := -1
 		for key, val := range cprx.Owners {
 			if val.Company == cp.Issuer {
-				cprx.Owners[key].Quantity += cp.Qty
+				issuerEntry = key
 				break
 			}
 		}
+		if issuerEntry < 0 {
+			fmt.Println("The issuer has no entry on existing CUSIP " + cp.CUSIP)
+			return nil, errors.New("The issuer " + cp.Issuer + " isn't an owner of existing CUSIP " + cp.CUSIP)
+		}
+
+		err = drawProgram(stub, cp, account)
+		if err != nil {
+			return nil, err
+		}
+
+		cprx.Qty = cprx.Qty + cp.Qty
+		cprx.Owners[issuerEntry].Quantity += cp.Qty
 
 		cpWriteBytes, err := json.Marshal(&cprx)
 		if err != nil {
@@ -395,8 +843,12 @@ func (t *SimpleChaincode) issueCommercialPaper(stub shim.ChaincodeStubInterface,
 			return nil, errors.New("Error issuing commercial paper")
 		}
 
-		fmt.Println("Updated commercial paper %+v\n", cprx)
-		return nil, nil
+		fmt.Printf("Updated commercial paper %+v\n", cprx)
+		err = settlePrimarySale(stub, cp.CUSIP, sale)
+		if err != nil {
+			return nil, err
+		}
+		return nil, chargeIssuanceFee(stub, cp, now)
 	}
 }
 
@@ -470,8 +922,109 @@ func GetCompany(companyID string, stub shim.ChaincodeStubInterface) (Account, er
 	return company, nil
 }
 
+func putCP(stub shim.ChaincodeStubInterface, cp CP) error {
+	cpBytes, err := json.Marshal(&cp)
+	if err != nil {
+		fmt.Println("Error marshalling cp " + cp.CUSIP)
+		return errors.New("Error marshalling cp " + cp.CUSIP)
+	}
+	err = stub.PutState(cpPrefix + cp.CUSIP, cpBytes)
+	if err != nil {
+		fmt.Println("Error writing cp " + cp.CUSIP + " back")
+		return errors.New("Error writing cp " + cp.CUSIP + " back")
+	}
+
+	return nil
+}
+
+func putTrade(stub shim.ChaincodeStubInterface, trade Trade) error {
+	tradeBytes, err := json.Marshal(&trade)
+	if err != nil {
+		fmt.Println("Error marshalling trade " + trade.ID)
+		return errors.New("Error marshalling trade " + trade.ID)
+	}
+	err = stub.PutState(tradePrefix + trade.ID, tradeBytes)
+	if err != nil {
+		fmt.Println("Error writing trade " + trade.ID)
+		return errors.New("Error writing trade " + trade.ID)
+	}
+
+	return nil
+}
+
+func GetTrade(tradeID string, stub shim.ChaincodeStubInterface) (Trade, error) {
+	var trade Trade
+
+	tradeBytes, err := stub.GetState(tradePrefix + tradeID)
+	if err != nil || tradeBytes == nil {
+		fmt.Println("Trade not found " + tradeID)
+		return trade, errors.New("Trade not found " + tradeID)
+	}
+
+	err = json.Unmarshal(tradeBytes, &trade)
+	if err != nil {
+		fmt.Println("Error unmarshalling trade " + tradeID)
+		return trade, errors.New("Error unmarshalling trade " + tradeID)
+	}
+
+	return trade, nil
+}
+
+// GetTrades returns every trade the company was a counterparty to
+func GetTrades(companyID string, stub shim.ChaincodeStubInterface) ([]Trade, error) {
+	var trades []Trade
+
+	company, err := GetCompany(companyID, stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, tradeID := range company.TradeIds {
+		trade, err := GetTrade(tradeID, stub)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	return trades, nil
+}
+
+// paperHolders loads the account of every company other than the issuer that
+// holds some of the paper, along with the quantity each one holds
+func paperHolders(stub shim.ChaincodeStubInterface, cp CP) ([]Account, []int, error) {
+	var holders []Account
+	var quantities []int
+	for _, owner := range cp.Owners {
+		if owner.Company == cp.Issuer || owner.Quantity == 0 {
+			continue
+		}
+		holder, err := GetCompany(owner.Company, stub)
+		if err != nil {
+			return nil, nil, err
+		}
+		holders = append(holders, holder)
+		quantities = append(quantities, owner.Quantity)
+	}
+
+	return holders, quantities, nil
+}
+
+func putCompany(stub shim.ChaincodeStubInterface, company Account) error {
+	companyBytes, err := json.Marshal(&company)
+	if err != nil {
+		fmt.Println("Error marshalling account " + company.ID)
+		return errors.New("Error marshalling account " + company.ID)
+	}
+	err = stub.PutState(accountPrefix + company.ID, companyBytes)
+	if err != nil {
+		fmt.Println("Error writing account " + company.ID + " back")
+		return errors.New("Error writing account " + company.ID + " back")
+	}
+
+	return nil
+}
+
 
-// Still working on this one
 func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("Transferring Paper")
 	/*		0
@@ -480,7 +1033,9 @@ func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args [
 			  "CUSIP": "",
 			  "fromCompany":"",
 			  "toCompany":"",
-			  "quantity": 1
+			  "quantity": 1,
+			  "discount": 7.5,  (negotiated rate, the issuance discount is used if not given)
+			  "currency": "USD" (not required, must be the paper's currency if given)
 		}
 	*/
 	//need one arg
@@ -497,11 +1052,33 @@ func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args [
 		return nil, errors.New("Invalid commercial paper issue")
 	}
 
+	// The seller only proposes the transfer, it settles when the buyer
+	// accepts it with acceptTransfer
+	proposal, err := proposeTransfer(stub, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Successfully completed Invoke")
+	return json.Marshal(&proposal)
+}
+
+// settleTransfer loads the paper and both companies, settles the transfer
+// and writes everything back along with the trade record and any fee. Every
+// way of trading paper settles through here.
+func settleTransfer(stub shim.ChaincodeStubInterface, tr Transaction, tradeID string, now time.Time) (Trade, error) {
+	var trade Trade
+
+	if tr.FromCompany == tr.ToCompany {
+		fmt.Println("The company " + tr.FromCompany + " can't transfer paper to itself")
+		return trade, errors.New("The company " + tr.FromCompany + " can't transfer paper to itself")
+	}
+
 	fmt.Println("Getting State on CP " + tr.CUSIP)
 	cpBytes, err := stub.GetState(cpPrefix + tr.CUSIP)
 	if err != nil {
 		fmt.Println("CUSIP not found")
-		return nil, errors.New("CUSIP not found " + tr.CUSIP)
+		return trade, errors.New("CUSIP not found " + tr.CUSIP)
 	}
 
 	var cp CP
@@ -509,7 +1086,7 @@ func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args [
 	err = json.Unmarshal(cpBytes, &cp)
 	if err != nil {
 		fmt.Println("Error unmarshalling cp " + tr.CUSIP)
-		return nil, errors.New("Error unmarshalling cp " + tr.CUSIP)
+		return trade, errors.New("Error unmarshalling cp " + tr.CUSIP)
 	}
 
 	var fromCompany Account
@@ -517,14 +1094,14 @@ func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args [
 	fromCompanyBytes, err := stub.GetState(accountPrefix + tr.FromCompany)
 	if err != nil {
 		fmt.Println("Account not found " + tr.FromCompany)
-		return nil, errors.New("Account not found " + tr.FromCompany)
+		return trade, errors.New("Account not found " + tr.FromCompany)
 	}
 
 	fmt.Println("Unmarshalling FromCompany ")
 	err = json.Unmarshal(fromCompanyBytes, &fromCompany)
 	if err != nil {
 		fmt.Println("Error unmarshalling account " + tr.FromCompany)
-		return nil, errors.New("Error unmarshalling account " + tr.FromCompany)
+		return trade, errors.New("Error unmarshalling account " + tr.FromCompany)
 	}
 
 	var toCompany Account
@@ -532,67 +1109,219 @@ func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args [
 	toCompanyBytes, err := stub.GetState(accountPrefix + tr.ToCompany)
 	if err != nil {
 		fmt.Println("Account not found " + tr.ToCompany)
-		return nil, errors.New("Account not found " + tr.ToCompany)
+		return trade, errors.New("Account not found " + tr.ToCompany)
 	}
 
 	fmt.Println("Unmarshalling tocompany")
 	err = json.Unmarshal(toCompanyBytes, &toCompany)
 	if err != nil {
 		fmt.Println("Error unmarshalling account " + tr.ToCompany)
-		return nil, errors.New("Error unmarshalling account " + tr.ToCompany)
+		return trade, errors.New("Error unmarshalling account " + tr.ToCompany)
 	}
 
-	// Check for all the possible errors
-	ownerFound := false
-	quantity := 0
-	for _, owner := range cp.Owners {
-		if owner.Company == tr.FromCompany {
-			ownerFound = true
-			quantity = owner.Quantity
-		}
+	trade, err = executeTransfer(&cp, &fromCompany, &toCompany, tr, now)
+	if err != nil {
+		return trade, err
 	}
+	trade.ID = tradeID
+	fromCompany.TradeIds = append(fromCompany.TradeIds, trade.ID)
+	toCompany.TradeIds = append(toCompany.TradeIds, trade.ID)
 
-	// If fromCompany doesn't own this paper
-	if ownerFound == false {
-		fmt.Println("The company " + tr.FromCompany + "doesn't own any of this paper")
-		return nil, errors.New("The company " + tr.FromCompany + "doesn't own any of this paper")
-	} else {
-		fmt.Println("The FromCompany does own this paper")
+	// The operator's fee comes out of the seller's proceeds
+	schedule, err := GetFeeSchedule(stub)
+	if err != nil {
+		return trade, err
+	}
+	trade.Fee = schedule.Transfer.amount(trade.Amount)
+	err = chargeFee(stub, schedule, FeeRecord{
+		ID:        trade.ID,
+		Kind:      transferFee,
+		Payer:     trade.FromCompany,
+		CUSIP:     trade.CUSIP,
+		Currency:  trade.Currency,
+		Basis:     trade.Amount,
+		Amount:    trade.Fee,
+		Timestamp: trade.Timestamp,
+	}, &fromCompany, &toCompany)
+	if err != nil {
+		return trade, err
 	}
 
-	// If fromCompany doesn't own enough quantity of this paper
-	if quantity < tr.Quantity {
-		fmt.Println("The company " + tr.FromCompany + "doesn't own enough of this paper")
-		return nil, errors.New("The company " + tr.FromCompany + "doesn't own enough of this paper")
-	} else {
-		fmt.Println("The FromCompany owns enough of this paper")
+	// Write everything back
+	err = putCompany(stub, toCompany)
+	if err != nil {
+		return trade, err
+	}
+	err = putCompany(stub, fromCompany)
+	if err != nil {
+		return trade, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return trade, err
+	}
+	err = putTrade(stub, trade)
+	if err != nil {
+		return trade, err
+	}
+	err = markHoldsConsumed(stub, trade.Holds, trade.ID, trade.Timestamp)
+	if err != nil {
+		return trade, err
 	}
 
-	amountToBeTransferred := float64(tr.Quantity) * cp.Par
-	amountToBeTransferred -= (amountToBeTransferred) * (cp.Discount / 100.0) * (float64(cp.Maturity) / 360.0)
+	return trade, nil
+}
 
-	// If toCompany doesn't have enough cash to buy the papers
-	if toCompany.CashBalance < amountToBeTransferred {
-		fmt.Println("The company " + tr.ToCompany + "doesn't have enough cash to purchase the papers")
-		return nil, errors.New("The company " + tr.ToCompany + "doesn't have enough cash to purchase the papers")
-	} else {
-		fmt.Println("The ToCompany has enough money to be transferred for this paper")
+// transferTerms checks a transfer's terms against the paper and returns
+// the currency it settles in
+func transferTerms(cp CP, tr Transaction) (string, error) {
+	// Matured paper has been redeemed and can no longer be traded
+	if cp.Status == paperMatured {
+		fmt.Println("The paper " + tr.CUSIP + " has matured")
+		return "", errors.New("The paper " + tr.CUSIP + " has matured and can't be transferred")
+	}
+	if cp.Status == paperDefaulted && !cp.Distressed {
+		fmt.Println("The paper " + tr.CUSIP + " is in default")
+		return "", errors.New("The paper " + tr.CUSIP + " is in default and not flagged for distressed trading")
 	}
 
-	toCompany.CashBalance -= amountToBeTransferred
-	fromCompany.CashBalance += amountToBeTransferred
+	if tr.Quantity <= 0 {
+		fmt.Println("Invalid transfer quantity")
+		return "", errors.New("Transfer quantity must be positive")
+	}
 
-	toOwnerFound := false
-	for key, owner := range cp.Owners {
-		if owner.Company == tr.FromCompany {
-			fmt.Println("Reducing Quantity from the FromCompany")
-			cp.Owners[key].Quantity -= tr.Quantity
-			//			owner.Quantity -= tr.Quantity
-		}
-		if owner.Company == tr.ToCompany {
-			fmt.Println("Increasing Quantity from the ToCompany")
-			toOwnerFound = true
-			cp.Owners[key].Quantity += tr.Quantity
+	// Cash only ever moves in the currency the paper was issued in
+	currency := paperCurrency(cp)
+	if tr.Currency != "" && tr.Currency != currency {
+		fmt.Println("Transfer currency doesn't match the paper")
+		return "", errors.New("The paper " + tr.CUSIP + " settles in " + currency + ", not " + tr.Currency)
+	}
+
+	return currency, nil
+}
+
+// transferPrice returns the rate a transfer settles at and the cash the
+// buyer pays for it on the given date
+func transferPrice(cp CP, tr Transaction, now time.Time) (Rate, Money, error) {
+	// Trades settle at the rate the counterparties agreed, falling back to
+	// the rate the paper was issued at
+	discount := cp.Discount
+	if tr.Discount != nil {
+		discount = *tr.Discount
+	}
+	if discount < 0 || discount >= 100 * rateScale {
+		fmt.Println("Invalid transfer discount")
+		return discount, 0, errors.New("Transfer discount must be at least 0 and below 100")
+	}
+
+	// Price the paper on the time it has left to run. Distressed paper is
+	// past maturity and trades at what is still owed on it, less any
+	// negotiated discount.
+	var amount Money
+	if cp.Status == paperDefaulted {
+		value, err := maturityValue(cp)
+		if err != nil {
+			return discount, 0, err
+		}
+		if tr.Discount == nil {
+			discount = 0
+		}
+		claim := new(big.Rat).Mul((value - cp.Recovered).rat(), big.NewRat(int64(tr.Quantity), 1))
+		haircut := new(big.Rat).Sub(big.NewRat(1, 1), discount.fraction())
+		amount = moneyFromRat(claim.Mul(claim, haircut))
+	} else {
+		_, err := daysToMaturity(cp, now)
+		if err != nil {
+			fmt.Println("The paper " + tr.CUSIP + " has reached maturity")
+			return discount, 0, errors.New(err.Error() + " and can't be transferred")
+		}
+		amount, err = paperPrice(cp, tr.Quantity, discount, now)
+		if err != nil {
+			return discount, 0, err
+		}
+	}
+
+	return discount, amount, nil
+}
+
+// executeTransfer checks a transfer against the paper and both accounts and,
+// if it can settle, moves the quantity and the cash between them. Nothing
+// is written, the caller puts the updated records back.
+func executeTransfer(cp *CP, fromCompany *Account, toCompany *Account, tr Transaction, now time.Time) (Trade, error) {
+	var trade Trade
+
+	currency, err := transferTerms(*cp, tr)
+	if err != nil {
+		return trade, err
+	}
+
+	// Holds placed for this transfer are taken off first so what they
+	// reserved counts as available
+	err = consumeHoldEntries(cp, fromCompany, toCompany, tr.Holds, now)
+	if err != nil {
+		return trade, err
+	}
+
+	// Check for all the possible errors
+	ownerFound := false
+	quantity := 0
+	for _, owner := range cp.Owners {
+		if owner.Company == tr.FromCompany {
+			ownerFound = true
+			quantity = owner.Quantity
+		}
+	}
+
+	// If fromCompany doesn't own this paper
+	if ownerFound == false {
+		fmt.Println("The company " + tr.FromCompany + "doesn't own any of this paper")
+		return trade, errors.New("The company " + tr.FromCompany + "doesn't own any of this paper")
+	} else {
+		fmt.Println("The FromCompany does own this paper")
+	}
+
+	// If fromCompany doesn't own enough quantity of this paper
+	if quantity < tr.Quantity {
+		fmt.Println("The company " + tr.FromCompany + "doesn't own enough of this paper")
+		return trade, errors.New("The company " + tr.FromCompany + "doesn't own enough of this paper")
+	} else {
+		fmt.Println("The FromCompany owns enough of this paper")
+	}
+
+	// Collateral held under a repo has to be handed back, not sold, and
+	// paper on hold is reserved for another settlement
+	if free := available(*cp, tr.FromCompany, now); free < tr.Quantity {
+		fmt.Println("The company " + tr.FromCompany + " holds this paper as repo collateral or on hold")
+		return trade, errors.New("The company " + tr.FromCompany + " has " + strconv.Itoa(quantity - free) + " of this paper held as repo collateral or on hold and can't transfer it")
+	}
+
+	discount, amountToBeTransferred, err := transferPrice(*cp, tr, now)
+	if err != nil {
+		return trade, err
+	}
+
+	// If toCompany doesn't have enough cash to buy the papers
+	if availableCash(*toCompany, currency, now) < amountToBeTransferred {
+		fmt.Println("The company " + tr.ToCompany + "doesn't have enough cash to purchase the papers")
+		return trade, errors.New("The company " + tr.ToCompany + "doesn't have enough " + currency + " cash to purchase the papers")
+	} else {
+		fmt.Println("The ToCompany has enough money to be transferred for this paper")
+	}
+
+	addCash(toCompany, currency, -amountToBeTransferred)
+	addCash(fromCompany, currency, amountToBeTransferred)
+
+	toOwnerFound := false
+	for key, owner := range cp.Owners {
+		if owner.Company == tr.FromCompany {
+			fmt.Println("Reducing Quantity from the FromCompany")
+			cp.Owners[key].Quantity -= tr.Quantity
+			//			owner.Quantity -= tr.Quantity
+		}
+		if owner.Company == tr.ToCompany {
+			fmt.Println("Increasing Quantity from the ToCompany")
+			toOwnerFound = true
+			cp.Owners[key].Quantity += tr.Quantity
 			//			owner.Quantity += tr.Quantity
 		}
 	}
@@ -607,47 +1336,524 @@ func (t *SimpleChaincode) transferPaper(stub shim.ChaincodeStubInterface, args [
 
 	fromCompany.AssetsIds = append(fromCompany.AssetsIds, tr.CUSIP)
 
+	trade = Trade{
+		CUSIP:       tr.CUSIP,
+		FromCompany: tr.FromCompany,
+		ToCompany:   tr.ToCompany,
+		Quantity:    tr.Quantity,
+		Discount:    discount,
+		Amount:      amountToBeTransferred,
+		Currency:    currency,
+		Holds:       tr.Holds,
+		Timestamp:   timeToMs(now),
+	}
+	return trade, nil
+}
+
+func (t *SimpleChaincode) redeemPaper(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Redeeming Paper")
+	/*		0
+		CUSIP
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting CUSIP")
+	}
+	cusip := args[0]
+
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.Status == paperMatured {
+		fmt.Println("The paper " + cusip + " has already been redeemed")
+		return nil, errors.New("The paper " + cusip + " has already been redeemed")
+	}
+	if cp.Status == paperDefaulted {
+		fmt.Println("The paper " + cusip + " is in default")
+		return nil, errors.New("The paper " + cusip + " is in default, use distributeRecovery")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	maturity, err := maturityDate(cp)
+	if err != nil {
+		fmt.Println("Error computing maturity date of " + cusip)
+		return nil, errors.New("Invalid issue date on cp " + cusip)
+	}
+	if now.Before(maturity) {
+		fmt.Println("The paper " + cusip + " has not matured yet")
+		return nil, errors.New("The paper " + cusip + " does not mature until " + maturity.Format("2006-01-02"))
+	}
+
+	issuer, err := GetCompany(cp.Issuer, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Work out what the issuer owes every holder. Paper still held by the
+	// issuer is simply retired.
+	holders, quantities, err := paperHolders(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+	value, err := maturityValue(cp)
+	if err != nil {
+		return nil, err
+	}
+	var payments []Money
+	var total Money
+	for _, quantity := range quantities {
+		payment := Money(quantity) * value
+		payments = append(payments, payment)
+		total += payment
+	}
+
+	currency := paperCurrency(cp)
+	if availableCash(issuer, currency, now) < total {
+		fmt.Println("The issuer " + cp.Issuer + " doesn't have enough cash to redeem " + cusip)
+		return nil, errors.New("The issuer " + cp.Issuer + " doesn't have enough " + currency + " cash to redeem " + cusip + ", use declareDefault")
+	}
+
+	addCash(&issuer, currency, -total)
+	for i := range holders {
+		addCash(&holders[i], currency, payments[i])
+	}
+	cp.Status = paperMatured
+
+	// Collateral out on repo was paid to the lender, who owes it back
+	err = passRepoIncome(stub, cp, value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = releaseProgram(stub, cp, cp.Qty)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write everything back
+	for _, holder := range holders {
+		err = putCompany(stub, holder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putCompany(stub, issuer)
+	if err != nil {
+		return nil, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lent paper has been paid to whoever holds it now, the borrowers pay
+	// the lenders its value out of their loans
+	err = matureLoans(stub, cp, value, now)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Successfully redeemed " + cusip)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) callPaper(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Calling Paper")
+	/*		0
+		json
+	  	{
+			  "cusip": "",
+			  "quantity": 1  (0 calls all outstanding quantity)
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting call record")
+	}
+
+	var call struct {
+		CUSIP    string `json:"cusip"`
+		Quantity int    `json:"quantity"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &call)
+	if err != nil {
+		fmt.Println("Error unmarshalling call")
+		return nil, errors.New("Invalid call record")
+	}
+
+	cp, err := GetCP(cpPrefix + call.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Status == paperMatured || cp.Status == paperDefaulted {
+		fmt.Println("The paper " + call.CUSIP + " is " + cp.Status)
+		return nil, errors.New("The paper " + call.CUSIP + " is " + cp.Status + " and can't be called")
+	}
+
+	if call.Quantity == 0 {
+		call.Quantity = cp.Qty
+	}
+	if call.Quantity < 0 || call.Quantity > cp.Qty {
+		fmt.Println("Invalid call quantity for " + call.CUSIP)
+		return nil, errors.New("Call quantity must be between 1 and " + strconv.Itoa(cp.Qty))
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	_, err = daysToMaturity(cp, now)
+	if err != nil {
+		fmt.Println("Can't call " + call.CUSIP + " at or after maturity")
+		return nil, errors.New(err.Error() + ", use redeemPaper instead")
+	}
+
+	issuer, err := GetCompany(cp.Issuer, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Paper the issuer already holds is retired first, the rest is bought
+	// back from the other holders pro rata. Repo collateral and paper on
+	// hold isn't called.
+	remaining := call.Quantity
+	callable := 0
+	var holderKeys []int
+	var weights []int
+	for key, owner := range cp.Owners {
+		free := available(cp, owner.Company, now)
+		if owner.Company == cp.Issuer {
+			retired := free
+			if retired > remaining {
+				retired = remaining
+			}
+			cp.Owners[key].Quantity -= retired
+			remaining -= retired
+		} else if free > 0 {
+			holderKeys = append(holderKeys, key)
+			weights = append(weights, free)
+			callable += free
+		}
+	}
+	if remaining > callable {
+		fmt.Println("Not enough of " + call.CUSIP + " is free to call")
+		return nil, errors.New("Only " + strconv.Itoa(call.Quantity - remaining + callable) + " of " + call.CUSIP + " can be called, the rest is held as repo collateral or on hold")
+	}
+
+	var holders []Account
+	var payments []Money
+	var total Money
+	for i, quantity := range allocateProRata(remaining, weights) {
+		if quantity == 0 {
+			continue
+		}
+		key := holderKeys[i]
+		holder, err := GetCompany(cp.Owners[key].Company, stub)
+		if err != nil {
+			return nil, err
+		}
+		payment, err := paperPrice(cp, quantity, cp.Discount, now)
+		if err != nil {
+			return nil, err
+		}
+		cp.Owners[key].Quantity -= quantity
+		holders = append(holders, holder)
+		payments = append(payments, payment)
+		total += payment
+	}
+
+	// The call settles in full or not at all
+	currency := paperCurrency(cp)
+	if availableCash(issuer, currency, now) < total {
+		fmt.Println("The issuer " + cp.Issuer + " doesn't have enough cash to call " + call.CUSIP)
+		return nil, errors.New("The issuer " + cp.Issuer + " doesn't have enough " + currency + " cash to call " + call.CUSIP)
+	}
+
+	addCash(&issuer, currency, -total)
+	for i := range holders {
+		addCash(&holders[i], currency, payments[i])
+	}
+	cp.Qty -= call.Quantity
+
+	err = releaseProgram(stub, cp, call.Quantity)
+	if err != nil {
+		return nil, err
+	}
+
 	// Write everything back
-	// To Company
-	toCompanyBytesToWrite, err := json.Marshal(&toCompany)
+	for _, holder := range holders {
+		err = putCompany(stub, holder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putCompany(stub, issuer)
+	if err != nil {
+		return nil, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Successfully called " + strconv.Itoa(call.Quantity) + " of " + call.CUSIP)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) declareDefault(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Declaring Default")
+	/*		0
+		CUSIP
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting CUSIP")
+	}
+	cusip := args[0]
+
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Status == paperMatured || cp.Status == paperDefaulted {
+		fmt.Println("The paper " + cusip + " is already " + cp.Status)
+		return nil, errors.New("The paper " + cusip + " is already " + cp.Status)
+	}
+
+	now, err := txTime(stub)
 	if err != nil {
-		fmt.Println("Error marshalling the toCompany")
-		return nil, errors.New("Error marshalling the toCompany")
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
 	}
-	fmt.Println("Put state on toCompany")
-	err = stub.PutState(accountPrefix + tr.ToCompany, toCompanyBytesToWrite)
+	maturity, err := maturityDate(cp)
 	if err != nil {
-		fmt.Println("Error writing the toCompany back")
-		return nil, errors.New("Error writing the toCompany back")
+		fmt.Println("Error computing maturity date of " + cusip)
+		return nil, errors.New("Invalid issue date on cp " + cusip)
+	}
+	if now.Before(maturity) {
+		fmt.Println("The paper " + cusip + " has not matured yet")
+		return nil, errors.New("The paper " + cusip + " does not mature until " + maturity.Format("2006-01-02"))
 	}
 
-	// From company
-	fromCompanyBytesToWrite, err := json.Marshal(&fromCompany)
+	issuer, err := GetCompany(cp.Issuer, stub)
 	if err != nil {
-		fmt.Println("Error marshalling the fromCompany")
-		return nil, errors.New("Error marshalling the fromCompany")
+		return nil, err
 	}
-	fmt.Println("Put state on fromCompany")
-	err = stub.PutState(accountPrefix + tr.FromCompany, fromCompanyBytesToWrite)
+
+	// A default can only be declared when the issuer can't redeem in full
+	_, quantities, err := paperHolders(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+	value, err := maturityValue(cp)
 	if err != nil {
-		fmt.Println("Error writing the fromCompany back")
-		return nil, errors.New("Error writing the fromCompany back")
+		return nil, err
+	}
+	var owed Money
+	for _, quantity := range quantities {
+		owed += Money(quantity) * value
 	}
+	if availableCash(issuer, paperCurrency(cp), now) >= owed {
+		fmt.Println("The issuer " + cp.Issuer + " can redeem " + cusip)
+		return nil, errors.New("The issuer " + cp.Issuer + " has enough cash to redeem " + cusip)
+	}
+
+	cp.Status = paperDefaulted
+	issuer.Defaulted = true
 
-	// cp
-	cpBytesToWrite, err := json.Marshal(&cp)
+	err = putCompany(stub, issuer)
 	if err != nil {
-		fmt.Println("Error marshalling the cp")
-		return nil, errors.New("Error marshalling the cp")
+		return nil, err
 	}
-	fmt.Println("Put state on CP")
-	err = stub.PutState(cpPrefix + tr.CUSIP, cpBytesToWrite)
+	err = putCP(stub, cp)
 	if err != nil {
-		fmt.Println("Error writing the cp back")
-		return nil, errors.New("Error writing the cp back")
+		return nil, err
 	}
 
-	fmt.Println("Successfully completed Invoke")
+	fmt.Println("Declared default on " + cusip)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) distributeRecovery(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Distributing Recovery")
+	/*		0
+		CUSIP
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting CUSIP")
+	}
+	cusip := args[0]
+
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Status != paperDefaulted {
+		fmt.Println("The paper " + cusip + " is not in default")
+		return nil, errors.New("The paper " + cusip + " is not in default")
+	}
+
+	issuer, err := GetCompany(cp.Issuer, stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	// Cash the issuer has on hold is not distributed
+	currency := paperCurrency(cp)
+	if availableCash(issuer, currency, now) <= 0 {
+		fmt.Println("The issuer " + cp.Issuer + " has no cash to distribute")
+		return nil, errors.New("The issuer " + cp.Issuer + " has no " + currency + " cash to distribute")
+	}
+
+	holders, quantities, err := paperHolders(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+	held := 0
+	for _, quantity := range quantities {
+		held += quantity
+	}
+
+	// Holders share whatever the issuer has, up to what they are still owed,
+	// in proportion to the quantity they hold. Only whole cents per unit are
+	// paid out, anything left over stays with the issuer.
+	value, err := maturityValue(cp)
+	if err != nil {
+		return nil, err
+	}
+	owed := Money(held) * (value - cp.Recovered)
+	distribution := availableCash(issuer, currency, now)
+	if distribution > owed {
+		distribution = owed
+	}
+	var perUnit Money
+	if held > 0 {
+		perUnit = distribution / Money(held)
+		if perUnit == 0 {
+			fmt.Println("The issuer " + cp.Issuer + " doesn't have a cent per unit to distribute")
+			return nil, errors.New("The issuer " + cp.Issuer + " doesn't have enough cash to distribute a cent per unit of " + cusip)
+		}
+	}
+	distribution = perUnit * Money(held)
+
+	addCash(&issuer, currency, -distribution)
+	for i := range holders {
+		addCash(&holders[i], currency, perUnit * Money(quantities[i]))
+	}
+	cp.Recovered += perUnit
+	err = passRepoIncome(stub, cp, perUnit)
+	if err != nil {
+		return nil, err
+	}
+	err = passLoanIncome(stub, cp, perUnit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Once holders are made whole the paper is settled like a redemption
+	if distribution == owed {
+		fmt.Println("Holders of " + cusip + " fully recovered")
+		cp.Status = paperMatured
+		cp.Distressed = false
+		cp.Recovered = 0
+		issuer.Defaulted, err = hasOtherDefaults(stub, cp)
+		if err != nil {
+			return nil, err
+		}
+		err = releaseProgram(stub, cp, cp.Qty)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Write everything back
+	for _, holder := range holders {
+		err = putCompany(stub, holder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putCompany(stub, issuer)
+	if err != nil {
+		return nil, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lent paper of a settled default ends like redeemed paper. Everything
+	// recovered has already been passed on as loan income, so nothing more
+	// is owed for it.
+	if cp.Status == paperMatured {
+		err = matureLoans(stub, cp, 0, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Distributed " + distribution.String() + " " + currency + " to holders of " + cusip)
+	return nil, nil
+}
+
+// hasOtherDefaults reports whether the issuer of cp has any other paper in default
+func hasOtherDefaults(stub shim.ChaincodeStubInterface, cp CP) (bool, error) {
+	allCPs, err := GetAllCPs(stub)
+	if err != nil {
+		return false, err
+	}
+	for _, other := range allCPs {
+		if other.Issuer == cp.Issuer && other.CUSIP != cp.CUSIP && other.Status == paperDefaulted {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (t *SimpleChaincode) flagDistressed(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Flagging Distressed Paper")
+	/*		0		1
+		CUSIP	"true" or "false"
+	*/
+	//need two args
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting CUSIP and flag")
+	}
+	cusip := args[0]
+	distressed, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return nil, errors.New("Invalid distressed flag " + args[1])
+	}
+
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Status != paperDefaulted {
+		fmt.Println("The paper " + cusip + " is not in default")
+		return nil, errors.New("Only paper in default can be flagged as distressed")
+	}
+
+	cp.Distressed = distressed
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Set distressed flag on " + cusip + " to " + args[1])
 	return nil, nil
 }
 
@@ -699,8 +1905,484 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 			fmt.Println("All success, returning the company")
 			return companyBytes, nil
 		}
+	} else if function == "GetIssuanceLimits" {
+		fmt.Println("Getting the issuance limits")
+		limits, err := GetIssuanceLimits(stub)
+		if err != nil {
+			fmt.Println("Error from getIssuanceLimits")
+			return nil, err
+		} else {
+			limitsBytes, err1 := json.Marshal(&limits)
+			if err1 != nil {
+				fmt.Println("Error marshalling the issuance limits")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the issuance limits")
+			return limitsBytes, nil
+		}
+	} else if function == "GetTrade" {
+		fmt.Println("Getting the trade")
+		trade, err := GetTrade(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getTrade")
+			return nil, err
+		} else {
+			tradeBytes, err1 := json.Marshal(&trade)
+			if err1 != nil {
+				fmt.Println("Error marshalling the trade")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the trade")
+			return tradeBytes, nil
+		}
+	} else if function == "GetTrades" {
+		fmt.Println("Getting the trades of a company")
+		trades, err := GetTrades(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getTrades")
+			return nil, err
+		} else {
+			tradesBytes, err1 := json.Marshal(&trades)
+			if err1 != nil {
+				fmt.Println("Error marshalling the trades")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the trades")
+			return tradesBytes, nil
+		}
+	} else if function == "GetQuote" {
+		fmt.Println("Getting a quote")
+		quote, err := GetQuote(args, stub)
+		if err != nil {
+			fmt.Println("Error from getQuote")
+			return nil, err
+		} else {
+			quoteBytes, err1 := json.Marshal(&quote)
+			if err1 != nil {
+				fmt.Println("Error marshalling the quote")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the quote")
+			return quoteBytes, nil
+		}
+	} else if function == "GetPortfolio" {
+		fmt.Println("Getting a portfolio")
+		portfolio, err := GetPortfolio(args, stub)
+		if err != nil {
+			fmt.Println("Error from getPortfolio")
+			return nil, err
+		} else {
+			portfolioBytes, err1 := json.Marshal(&portfolio)
+			if err1 != nil {
+				fmt.Println("Error marshalling the portfolio")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the portfolio")
+			return portfolioBytes, nil
+		}
+	} else if function == "GetPrograms" {
+		fmt.Println("Getting the issuance programs")
+		issuer := ""
+		if len(args) > 0 {
+			issuer = args[0]
+		}
+		programs, err := GetPrograms(issuer, stub)
+		if err != nil {
+			fmt.Println("Error from getPrograms")
+			return nil, err
+		} else {
+			programsBytes, err1 := json.Marshal(&programs)
+			if err1 != nil {
+				fmt.Println("Error marshalling the programs")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the programs")
+			return programsBytes, nil
+		}
+	} else if function == "GetFeeSchedule" {
+		fmt.Println("Getting the fee schedule")
+		schedule, err := GetFeeSchedule(stub)
+		if err != nil {
+			fmt.Println("Error from getFeeSchedule")
+			return nil, err
+		} else {
+			scheduleBytes, err1 := json.Marshal(&schedule)
+			if err1 != nil {
+				fmt.Println("Error marshalling the fee schedule")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the fee schedule")
+			return scheduleBytes, nil
+		}
+	} else if function == "GetFees" {
+		fmt.Println("Getting the fees collected")
+		fees, err := GetFees(args, stub)
+		if err != nil {
+			fmt.Println("Error from getFees")
+			return nil, err
+		} else {
+			feesBytes, err1 := json.Marshal(&fees)
+			if err1 != nil {
+				fmt.Println("Error marshalling the fees")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the fees")
+			return feesBytes, nil
+		}
+	} else if function == "GetOrderBook" {
+		fmt.Println("Getting the order book")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting CUSIP")
+		}
+		book, err := GetOrderBook(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getOrderBook")
+			return nil, err
+		} else {
+			bookBytes, err1 := json.Marshal(&book)
+			if err1 != nil {
+				fmt.Println("Error marshalling the order book")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the order book")
+			return bookBytes, nil
+		}
+	} else if function == "GetRFQ" {
+		fmt.Println("Getting the RFQ")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting RFQ ID")
+		}
+		rfq, err := GetRFQ(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getRFQ")
+			return nil, err
+		} else {
+			// Show quotes past their expiry as expired
+			now, err := txTime(stub)
+			if err == nil && rfq.Status == rfqOpen {
+				expireQuotes(&rfq, now)
+			}
+			rfqBytes, err1 := json.Marshal(&rfq)
+			if err1 != nil {
+				fmt.Println("Error marshalling the RFQ")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the RFQ")
+			return rfqBytes, nil
+		}
+	} else if function == "GetRFQs" {
+		fmt.Println("Getting the RFQs")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID")
+		}
+		rfqs, err := GetRFQs(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getRFQs")
+			return nil, err
+		} else {
+			rfqsBytes, err1 := json.Marshal(&rfqs)
+			if err1 != nil {
+				fmt.Println("Error marshalling the RFQs")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the RFQs")
+			return rfqsBytes, nil
+		}
+	} else if function == "GetProposals" {
+		fmt.Println("Getting the transfer proposals")
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally \"all\"")
+		}
+		proposals, err := GetProposals(args[0], len(args) == 2 && args[1] == "all", stub)
+		if err != nil {
+			fmt.Println("Error from getProposals")
+			return nil, err
+		} else {
+			proposalsBytes, err1 := json.Marshal(&proposals)
+			if err1 != nil {
+				fmt.Println("Error marshalling the proposals")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the proposals")
+			return proposalsBytes, nil
+		}
+	} else if function == "GetAuction" {
+		fmt.Println("Getting the auction")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting auction ID")
+		}
+		auction, err := GetAuction(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getAuction")
+			return nil, err
+		} else {
+			// Bids stay sealed until the auction closes, callers only see
+			// their own
+			bidder, _ := callerCompany(stub)
+			sealAuction(&auction, bidder)
+			auctionBytes, err1 := json.Marshal(&auction)
+			if err1 != nil {
+				fmt.Println("Error marshalling the auction")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the auction")
+			return auctionBytes, nil
+		}
+	} else if function == "GetAuctions" {
+		fmt.Println("Getting the open auctions")
+		if len(args) != 0 {
+			return nil, errors.New("Incorrect number of arguments. Expecting none")
+		}
+		bidder, _ := callerCompany(stub)
+		auctions, err := GetAuctions(bidder, stub)
+		if err != nil {
+			fmt.Println("Error from getAuctions")
+			return nil, err
+		} else {
+			auctionsBytes, err1 := json.Marshal(&auctions)
+			if err1 != nil {
+				fmt.Println("Error marshalling the auctions")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the auctions")
+			return auctionsBytes, nil
+		}
+	} else if function == "GetBatch" {
+		fmt.Println("Getting the batch")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting batch ID")
+		}
+		batch, err := GetBatch(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getBatch")
+			return nil, err
+		} else {
+			now, err := txTime(stub)
+			if err == nil {
+				expireBatch(&batch, now)
+			}
+			batchBytes, err1 := json.Marshal(&batch)
+			if err1 != nil {
+				fmt.Println("Error marshalling the batch")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the batch")
+			return batchBytes, nil
+		}
+	} else if function == "GetBatches" {
+		fmt.Println("Getting the batches")
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally \"all\"")
+		}
+		batches, err := GetBatches(args[0], len(args) == 2 && args[1] == "all", stub)
+		if err != nil {
+			fmt.Println("Error from getBatches")
+			return nil, err
+		} else {
+			batchesBytes, err1 := json.Marshal(&batches)
+			if err1 != nil {
+				fmt.Println("Error marshalling the batches")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the batches")
+			return batchesBytes, nil
+		}
+	} else if function == "GetRepo" {
+		fmt.Println("Getting the repo")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting repo ID")
+		}
+		repo, err := GetRepo(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getRepo")
+			return nil, err
+		} else {
+			now, err := txTime(stub)
+			if err == nil {
+				expireRepo(&repo, now)
+			}
+			repoBytes, err1 := json.Marshal(&repo)
+			if err1 != nil {
+				fmt.Println("Error marshalling the repo")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the repo")
+			return repoBytes, nil
+		}
+	} else if function == "GetRepos" {
+		fmt.Println("Getting the repos")
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally \"all\"")
+		}
+		repos, err := GetRepos(args[0], len(args) == 2 && args[1] == "all", stub)
+		if err != nil {
+			fmt.Println("Error from getRepos")
+			return nil, err
+		} else {
+			reposBytes, err1 := json.Marshal(&repos)
+			if err1 != nil {
+				fmt.Println("Error marshalling the repos")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the repos")
+			return reposBytes, nil
+		}
+	} else if function == "GetLoan" {
+		fmt.Println("Getting the loan")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting loan ID")
+		}
+		loan, err := GetLoan(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getLoan")
+			return nil, err
+		} else {
+			// Show the fee accrued so far on an open loan
+			now, err := txTime(stub)
+			if err == nil {
+				expireLoan(&loan, now)
+				if loan.Status == loanOpen {
+					loan.Accrued, _ = loanFee(loan, now)
+				}
+			}
+			loanBytes, err1 := json.Marshal(&loan)
+			if err1 != nil {
+				fmt.Println("Error marshalling the loan")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the loan")
+			return loanBytes, nil
+		}
+	} else if function == "GetLoans" {
+		fmt.Println("Getting the outstanding loans")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID")
+		}
+		loans, err := GetLoans(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getLoans")
+			return nil, err
+		} else {
+			loansBytes, err1 := json.Marshal(&loans)
+			if err1 != nil {
+				fmt.Println("Error marshalling the loans")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the loans")
+			return loansBytes, nil
+		}
+	} else if function == "GetReversal" {
+		fmt.Println("Getting the reversal")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting reversal ID")
+		}
+		reversal, err := GetReversal(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getReversal")
+			return nil, err
+		} else {
+			now, err := txTime(stub)
+			if err == nil {
+				expireReversal(&reversal, now)
+			}
+			reversalBytes, err1 := json.Marshal(&reversal)
+			if err1 != nil {
+				fmt.Println("Error marshalling the reversal")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the reversal")
+			return reversalBytes, nil
+		}
+	} else if function == "GetReversals" {
+		fmt.Println("Getting the reversals")
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally \"all\"")
+		}
+		reversals, err := GetReversals(args[0], len(args) == 2 && args[1] == "all", stub)
+		if err != nil {
+			fmt.Println("Error from getReversals")
+			return nil, err
+		} else {
+			reversalsBytes, err1 := json.Marshal(&reversals)
+			if err1 != nil {
+				fmt.Println("Error marshalling the reversals")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the reversals")
+			return reversalsBytes, nil
+		}
+	} else if function == "GetNetting" {
+		fmt.Println("Getting the projected net settlement")
+		netting, err := GetNetting(stub)
+		if err != nil {
+			fmt.Println("Error from getNetting")
+			return nil, err
+		} else {
+			nettingBytes, err1 := json.Marshal(&netting)
+			if err1 != nil {
+				fmt.Println("Error marshalling the net settlement")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the net settlement")
+			return nettingBytes, nil
+		}
+	} else if function == "GetHolds" {
+		fmt.Println("Getting the holds")
+		if len(args) < 1 || len(args) > 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID and optionally \"all\"")
+		}
+		holds, err := GetHolds(args[0], len(args) == 2 && args[1] == "all", stub)
+		if err != nil {
+			fmt.Println("Error from getHolds")
+			return nil, err
+		} else {
+			holdsBytes, err1 := json.Marshal(&holds)
+			if err1 != nil {
+				fmt.Println("Error marshalling the holds")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the holds")
+			return holdsBytes, nil
+		}
+	} else if function == "GetFXRates" {
+		fmt.Println("Getting the FX rates")
+		fx, err := GetFXRates(stub)
+		if err != nil {
+			fmt.Println("Error from getFXRates")
+			return nil, err
+		} else {
+			fxBytes, err1 := json.Marshal(&fx)
+			if err1 != nil {
+				fmt.Println("Error marshalling the FX rates")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the FX rates")
+			return fxBytes, nil
+		}
+	} else if function == "GetCashPosition" {
+		fmt.Println("Getting the cash position")
+		if len(args) != 1 {
+			return nil, errors.New("Incorrect number of arguments. Expecting company ID")
+		}
+		position, err := GetCashPosition(args[0], stub)
+		if err != nil {
+			fmt.Println("Error from getCashPosition")
+			return nil, err
+		} else {
+			positionBytes, err1 := json.Marshal(&position)
+			if err1 != nil {
+				fmt.Println("Error marshalling the cash position")
+				return nil, err1
+			}
+			fmt.Println("All success, returning the cash position")
+			return positionBytes, nil
+		}
 	} else {
 		fmt.Println("Generic Query call")
+		// Auctions hold sealed bids, they are only read through GetAuction
+		if strings.HasPrefix(args[0], auctionPrefix) {
+			return nil, errors.New("Auctions can only be queried with GetAuction")
+		}
 		bytes, err := stub.GetState(args[0])
 
 		if err != nil {
@@ -724,6 +2406,94 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.createAccounts(stub, args)
 	} else if function == "createAccount" {
 		return t.createAccount(stub, args)
+	} else if function == "redeemPaper" {
+		return t.redeemPaper(stub, args)
+	} else if function == "callPaper" {
+		return t.callPaper(stub, args)
+	} else if function == "declareDefault" {
+		return t.declareDefault(stub, args)
+	} else if function == "distributeRecovery" {
+		return t.distributeRecovery(stub, args)
+	} else if function == "flagDistressed" {
+		return t.flagDistressed(stub, args)
+	} else if function == "setIssuanceLimits" {
+		return t.setIssuanceLimits(stub, args)
+	} else if function == "createProgram" {
+		return t.createProgram(stub, args)
+	} else if function == "allocatePaper" {
+		return t.allocatePaper(stub, args)
+	} else if function == "migrateMoney" {
+		return t.migrateMoney(stub, args)
+	} else if function == "setFXRates" {
+		return t.setFXRates(stub, args)
+	} else if function == "depositCash" {
+		return t.depositCash(stub, args)
+	} else if function == "setFeeSchedule" {
+		return t.setFeeSchedule(stub, args)
+	} else if function == "placeOrder" {
+		return t.placeOrder(stub, args)
+	} else if function == "cancelOrder" {
+		return t.cancelOrder(stub, args)
+	} else if function == "acceptTransfer" {
+		return t.acceptTransfer(stub, args)
+	} else if function == "rejectTransfer" {
+		return t.rejectTransfer(stub, args)
+	} else if function == "setProposalSettings" {
+		return t.setProposalSettings(stub, args)
+	} else if function == "openRepo" {
+		return t.openRepo(stub, args)
+	} else if function == "acceptRepo" {
+		return t.acceptRepo(stub, args)
+	} else if function == "rejectRepo" {
+		return t.rejectRepo(stub, args)
+	} else if function == "closeRepo" {
+		return t.closeRepo(stub, args)
+	} else if function == "offerLoan" {
+		return t.offerLoan(stub, args)
+	} else if function == "acceptLoan" {
+		return t.acceptLoan(stub, args)
+	} else if function == "rejectLoan" {
+		return t.rejectLoan(stub, args)
+	} else if function == "returnLoan" {
+		return t.returnLoan(stub, args)
+	} else if function == "recallLoan" {
+		return t.recallLoan(stub, args)
+	} else if function == "requestReversal" {
+		return t.requestReversal(stub, args)
+	} else if function == "approveReversal" {
+		return t.approveReversal(stub, args)
+	} else if function == "rejectReversal" {
+		return t.rejectReversal(stub, args)
+	} else if function == "netSettle" {
+		return t.netSettle(stub, args)
+	} else if function == "cancelObligation" {
+		return t.cancelObligation(stub, args)
+	} else if function == "placeHold" {
+		return t.placeHold(stub, args)
+	} else if function == "releaseHold" {
+		return t.releaseHold(stub, args)
+	} else if function == "batchTransfer" {
+		return t.batchTransfer(stub, args)
+	} else if function == "acceptBatch" {
+		return t.acceptBatch(stub, args)
+	} else if function == "rejectBatch" {
+		return t.rejectBatch(stub, args)
+	} else if function == "openRFQ" {
+		return t.openRFQ(stub, args)
+	} else if function == "submitQuote" {
+		return t.submitQuote(stub, args)
+	} else if function == "acceptQuote" {
+		return t.acceptQuote(stub, args)
+	} else if function == "cancelRFQ" {
+		return t.cancelRFQ(stub, args)
+	} else if function == "openAuction" {
+		return t.openAuction(stub, args)
+	} else if function == "submitBid" {
+		return t.submitBid(stub, args)
+	} else if function == "closeAuction" {
+		return t.closeAuction(stub, args)
+	} else if function == "cancelAuction" {
+		return t.cancelAuction(stub, args)
 	}
 
 	return nil, errors.New("Received unknown function invocation: " + function)
@@ -732,7 +2502,7 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 func main() {
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Println("Error starting Simple chaincode: %s", err)
+		fmt.Printf("Error starting Simple chaincode: %s\n", err)
 	}
 }
 
@@ -0,0 +1,125 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIssueIntoExistingCUSIP(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		later time.Duration
+		terms map[string]interface{}
+		merge bool
+	}{
+		{"same terms", 0, nil, true},
+		{"later the same day", time.Hour, nil, true},
+		{"other discount", 0, map[string]interface{}{"discount": 3.5}, false},
+		{"other par", 0, map[string]interface{}{"par": 500.00}, false},
+		{"other ticker", 0, map[string]interface{}{"ticker": "XYZ"}, false},
+		{"next day to the same maturity", 24 * time.Hour, map[string]interface{}{"maturity": 29}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cc, stub := newTestStub(t)
+			cusip := issueTestPaper(t, stub, cc, nil)
+			stub.now = stub.now.Add(test.later)
+
+			terms := map[string]interface{}{
+				"ticker":    "ABC",
+				"par":       1000.00,
+				"qty":       10,
+				"discount":  3.6,
+				"maturity":  30,
+				"issuer":    "company1",
+				"issueDate": ms(stub.now),
+				"owners":    []map[string]interface{}{{"company": "company2", "quantity": 4}},
+			}
+			for key, value := range test.terms {
+				terms[key] = value
+			}
+			_, err := invoke(stub, cc, "company1", "issueCommercialPaper", toJSON(t, terms))
+			if !test.merge {
+				if err == nil {
+					t.Fatal("paper with other terms was added to the CUSIP")
+				}
+				expectHoldings(t, stub, cusip, map[string]int{"company1": 10, "company2": 0})
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The new quantity is sold to company2 from the issuer's entry
+			expectHoldings(t, stub, cusip, map[string]int{"company1": 16, "company2": 4})
+			expectCash(t, stub, map[string]Money{
+				"company1": initialCashBalance + 398800,
+				"company2": initialCashBalance - 398800,
+			})
+		})
+	}
+}
+
+func TestNoIssueIntoDefaultedCUSIP(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+
+	// Paper can only default after maturity, when the CUSIP can't come up
+	// again, so the status is set directly
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Status = paperDefaulted
+	stub.MockTransactionStart("default")
+	err = putCP(stub, cp)
+	stub.MockTransactionEnd("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = invoke(stub, cc, "company1", "issueCommercialPaper", toJSON(t, map[string]interface{}{
+		"ticker":    "ABC",
+		"par":       1000.00,
+		"qty":       10,
+		"discount":  3.6,
+		"maturity":  30,
+		"issuer":    "company1",
+		"issueDate": ms(stub.now),
+	}))
+	if err == nil {
+		t.Error("paper was added to a defaulted CUSIP")
+	}
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 10})
+}
+
+func TestCUSIPSuffixCarriesTheYear(t *testing.T) {
+	first, err := generateCUSIPSuffix(ms(testStart), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := generateCUSIPSuffix(ms(testStart.AddDate(1, 0, 0)), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("paper maturing a year apart shares the suffix %s", first)
+	}
+}
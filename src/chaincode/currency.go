@@ -0,0 +1,302 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Papers and accounts written before currencies existed are in the default
+// currency. An account's CashBalance field always holds the default currency,
+// other currencies are kept in its Balances.
+const defaultCurrency = "USD"
+
+var fxRatesKey = "FXRates"
+
+// FXRate is the price of one unit of a currency in the base currency, held
+// as a whole number of millionths. In JSON it is a decimal number.
+type FXRate int64
+
+const fxScale = 1000000
+
+func (r FXRate) String() string {
+	text := formatDecimal(int64(r), fxScale, 6)
+	text = strings.TrimRight(text, "0")
+	return strings.TrimSuffix(text, ".")
+}
+
+func (r FXRate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *FXRate) UnmarshalJSON(data []byte) error {
+	units, err := parseDecimal(data, fxScale)
+	if err != nil {
+		return err
+	}
+	*r = FXRate(units)
+	return nil
+}
+
+// FXRates is the admin maintained table used to report amounts in a single
+// base currency
+type FXRates struct {
+	Base  string            `json:"base"`
+	Rates map[string]FXRate `json:"rates"`
+}
+
+// CashPosition is a company's cash in every currency it holds, with the
+// total in the base currency
+type CashPosition struct {
+	Company  string           `json:"company"`
+	Base     string           `json:"base"`
+	Balances map[string]Money `json:"balances"`
+	Total    Money            `json:"total"`
+}
+
+// validCurrency reports whether code looks like an ISO 4217 currency code
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// paperCurrency returns the currency the paper is issued and settled in
+func paperCurrency(cp CP) string {
+	if cp.Currency == "" {
+		return defaultCurrency
+	}
+	return cp.Currency
+}
+
+// cashBalance returns the account's cash in the given currency
+func cashBalance(account Account, currency string) Money {
+	if currency == defaultCurrency {
+		return account.CashBalance
+	}
+	return account.Balances[currency]
+}
+
+// addCash adds amount, which may be negative, to the account's cash in the
+// given currency
+func addCash(account *Account, currency string, amount Money) {
+	if currency == defaultCurrency {
+		account.CashBalance += amount
+		return
+	}
+	if account.Balances == nil {
+		account.Balances = make(map[string]Money)
+	}
+	account.Balances[currency] += amount
+	if account.Balances[currency] == 0 {
+		delete(account.Balances, currency)
+	}
+}
+
+// GetFXRates returns the stored FX rate table, or an empty table in the
+// default currency if none has been set
+func GetFXRates(stub shim.ChaincodeStubInterface) (FXRates, error) {
+	fx := FXRates{Base: defaultCurrency, Rates: map[string]FXRate{}}
+
+	fxBytes, err := stub.GetState(fxRatesKey)
+	if err != nil {
+		fmt.Println("Error retrieving FX rates")
+		return fx, errors.New("Error retrieving FX rates")
+	}
+	if fxBytes == nil {
+		return fx, nil
+	}
+
+	err = json.Unmarshal(fxBytes, &fx)
+	if err != nil {
+		fmt.Println("Error unmarshalling FX rates")
+		return fx, errors.New("Error unmarshalling FX rates")
+	}
+
+	return fx, nil
+}
+
+func (t *SimpleChaincode) setFXRates(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Setting FX rates")
+	/*		0
+		json
+	  	{
+			"base": "USD",
+			"rates": {
+				"EUR": 1.0875
+			}
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting FX rate table")
+	}
+	err := requireAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var fx FXRates
+	err = json.Unmarshal([]byte(args[0]), &fx)
+	if err != nil {
+		fmt.Println("Error unmarshalling FX rates")
+		return nil, errors.New("Invalid FX rate table")
+	}
+	if fx.Base == "" {
+		fx.Base = defaultCurrency
+	}
+	if !validCurrency(fx.Base) {
+		return nil, errors.New("Invalid base currency " + fx.Base)
+	}
+	for currency, rate := range fx.Rates {
+		if !validCurrency(currency) {
+			return nil, errors.New("Invalid currency " + currency)
+		}
+		if rate <= 0 {
+			return nil, errors.New("FX rate for " + currency + " must be positive")
+		}
+	}
+	delete(fx.Rates, fx.Base)
+
+	fxBytes, err := json.Marshal(&fx)
+	if err != nil {
+		fmt.Println("Error marshalling FX rates")
+		return nil, errors.New("Error marshalling FX rates")
+	}
+	err = stub.PutState(fxRatesKey, fxBytes)
+	if err != nil {
+		fmt.Println("Error writing FX rates")
+		return nil, errors.New("Error writing FX rates")
+	}
+
+	fmt.Println("FX rates set")
+	return nil, nil
+}
+
+// toBase converts an amount in the given currency to the base currency of
+// the FX rate table, rounded to the cent
+func toBase(amount Money, currency string, fx FXRates) (Money, error) {
+	if currency == fx.Base {
+		return amount, nil
+	}
+	rate, ok := fx.Rates[currency]
+	if !ok {
+		return 0, errors.New("No FX rate from " + currency + " to " + fx.Base)
+	}
+
+	converted := new(big.Rat).Mul(amount.rat(), big.NewRat(int64(rate), fxScale))
+	return moneyFromRat(converted), nil
+}
+
+func (t *SimpleChaincode) depositCash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Depositing cash")
+	/*		0
+		json
+	  	{
+			"company": "company1",
+			"currency": "EUR",
+			"amount": 1000000.00
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting deposit record")
+	}
+	// Cash comes onto the platform from outside, so only an admin can
+	// credit it
+	err := requireAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var deposit struct {
+		Company  string `json:"company"`
+		Currency string `json:"currency"`
+		Amount   Money  `json:"amount"`
+	}
+	err = json.Unmarshal([]byte(args[0]), &deposit)
+	if err != nil {
+		fmt.Println("Error unmarshalling deposit")
+		return nil, errors.New("Invalid deposit")
+	}
+	if deposit.Currency == "" {
+		deposit.Currency = defaultCurrency
+	}
+	if !validCurrency(deposit.Currency) {
+		return nil, errors.New("Invalid currency " + deposit.Currency)
+	}
+	if deposit.Amount <= 0 {
+		return nil, errors.New("Deposit amount must be positive")
+	}
+
+	company, err := GetCompany(deposit.Company, stub)
+	if err != nil {
+		return nil, err
+	}
+	addCash(&company, deposit.Currency, deposit.Amount)
+	err = putCompany(stub, company)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Deposited " + deposit.Amount.String() + " " + deposit.Currency + " to " + deposit.Company)
+	return nil, nil
+}
+
+// GetCashPosition returns the company's cash in each currency and its total
+// in the base currency of the FX rate table
+func GetCashPosition(companyID string, stub shim.ChaincodeStubInterface) (CashPosition, error) {
+	var position CashPosition
+
+	company, err := GetCompany(companyID, stub)
+	if err != nil {
+		return position, err
+	}
+	fx, err := GetFXRates(stub)
+	if err != nil {
+		return position, err
+	}
+
+	position = CashPosition{Company: company.ID, Base: fx.Base, Balances: map[string]Money{defaultCurrency: company.CashBalance}}
+	for currency, amount := range company.Balances {
+		position.Balances[currency] = amount
+	}
+
+	for currency, balance := range position.Balances {
+		amount, err := toBase(balance, currency, fx)
+		if err != nil {
+			return position, err
+		}
+		position.Total += amount
+	}
+
+	return position, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOnlyAdminsSetCash(t *testing.T) {
+	cc, stub := newTestStub(t)
+	deposit := toJSON(t, map[string]interface{}{
+		"company":  "company2",
+		"currency": "EUR",
+		"amount":   1000.00,
+	})
+	rates := toJSON(t, map[string]interface{}{
+		"base":  "USD",
+		"rates": map[string]float64{"EUR": 1.5},
+	})
+
+	for _, caller := range []string{"company1", "company2", ""} {
+		_, err := invoke(stub, cc, caller, "depositCash", deposit)
+		if err == nil {
+			t.Errorf("%q deposited cash", caller)
+		}
+		_, err = invoke(stub, cc, caller, "setFXRates", rates)
+		if err == nil {
+			t.Errorf("%q set the FX rates", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, testAdmin, "depositCash", deposit)
+	mustInvoke(t, stub, cc, testAdmin, "setFXRates", rates)
+
+	var position CashPosition
+	result, err := query(stub, cc, "company2", "GetCashPosition", "company2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(result, &position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position.Balances["EUR"] != 100000 || position.Total != initialCashBalance + 150000 {
+		t.Errorf("company2 has %s EUR and %s in total, want 1000.00 and %s", position.Balances["EUR"], position.Total, initialCashBalance + 150000)
+	}
+}
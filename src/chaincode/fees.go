@@ -0,0 +1,418 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var feeScheduleKey = "FeeSchedule"
+var feePrefix = "fee:"
+
+// Kinds of fee the operator charges
+const (
+	issuanceFee = "issuance"
+	transferFee = "transfer"
+	// feeRefund is a fee handed back, recorded as a negative amount
+	feeRefund   = "refund"
+)
+
+// Fee is either a flat amount or a number of basis points of the amount it
+// is charged on. A flat fee is charged in the currency of the paper.
+type Fee struct {
+	Flat        Money `json:"flat,omitempty"`
+	BasisPoints int   `json:"basisPoints,omitempty"`
+}
+
+// FeeSchedule is the operator's fee on each issuance, charged to the issuer
+// on the face value issued, and on each transfer, taken from the seller's
+// proceeds
+type FeeSchedule struct {
+	Operator string `json:"operator"`
+	Issuance Fee    `json:"issuance"`
+	Transfer Fee    `json:"transfer"`
+}
+
+// FeeRecord is a fee collected by the operator
+type FeeRecord struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Payer     string `json:"payer"`
+	CUSIP     string `json:"cusip"`
+	Currency  string `json:"currency"`
+	Basis     Money  `json:"basis"`
+	Amount    Money  `json:"amount"`
+	// Operator is the account the fee was credited to
+	Operator  string `json:"operator,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// FeeTotal is what one account paid in one currency over one period
+type FeeTotal struct {
+	Account  string `json:"account"`
+	Period   string `json:"period"`
+	Currency string `json:"currency"`
+	Count    int    `json:"count"`
+	Amount   Money  `json:"amount"`
+}
+
+// feeTotals sorts fee totals by account, period and currency
+type feeTotals []FeeTotal
+
+func (f feeTotals) Len() int      { return len(f) }
+func (f feeTotals) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f feeTotals) Less(i, j int) bool {
+	if f[i].Account != f[j].Account {
+		return f[i].Account < f[j].Account
+	}
+	if f[i].Period != f[j].Period {
+		return f[i].Period < f[j].Period
+	}
+	return f[i].Currency < f[j].Currency
+}
+
+// amount returns the fee on the given amount, rounded to the cent
+func (f Fee) amount(basis Money) Money {
+	if f.BasisPoints == 0 {
+		return f.Flat
+	}
+	fee := new(big.Rat).Mul(basis.rat(), big.NewRat(int64(f.BasisPoints), 10000))
+	return moneyFromRat(fee)
+}
+
+// GetFeeSchedule returns the stored fee schedule, or an empty schedule that
+// charges nothing if none has been set
+func GetFeeSchedule(stub shim.ChaincodeStubInterface) (FeeSchedule, error) {
+	var schedule FeeSchedule
+
+	scheduleBytes, err := stub.GetState(feeScheduleKey)
+	if err != nil {
+		fmt.Println("Error retrieving fee schedule")
+		return schedule, errors.New("Error retrieving fee schedule")
+	}
+	if scheduleBytes == nil {
+		return schedule, nil
+	}
+
+	err = json.Unmarshal(scheduleBytes, &schedule)
+	if err != nil {
+		fmt.Println("Error unmarshalling fee schedule")
+		return schedule, errors.New("Error unmarshalling fee schedule")
+	}
+
+	return schedule, nil
+}
+
+func (t *SimpleChaincode) setFeeSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Setting fee schedule")
+	/*		0
+		json
+	  	{
+			"operator": "operator",
+			"issuance": {
+				"basisPoints": 5
+			},
+			"transfer": {
+				"flat": 25.00
+			}
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting fee schedule")
+	}
+	err := requireAdmin(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule FeeSchedule
+	err = json.Unmarshal([]byte(args[0]), &schedule)
+	if err != nil {
+		fmt.Println("Error unmarshalling fee schedule")
+		return nil, errors.New("Invalid fee schedule")
+	}
+	err = validateFee(issuanceFee, schedule.Issuance)
+	if err != nil {
+		return nil, err
+	}
+	err = validateFee(transferFee, schedule.Transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The operator account must exist to be credited
+	_, err = GetCompany(schedule.Operator, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduleBytes, err := json.Marshal(&schedule)
+	if err != nil {
+		fmt.Println("Error marshalling fee schedule")
+		return nil, errors.New("Error marshalling fee schedule")
+	}
+	err = stub.PutState(feeScheduleKey, scheduleBytes)
+	if err != nil {
+		fmt.Println("Error writing fee schedule")
+		return nil, errors.New("Error writing fee schedule")
+	}
+
+	fmt.Println("Fee schedule set")
+	return nil, nil
+}
+
+// validateFee checks that a fee is a single non-negative charge
+func validateFee(kind string, fee Fee) error {
+	if fee.Flat < 0 || fee.BasisPoints < 0 {
+		return errors.New("The " + kind + " fee can't be negative")
+	}
+	if fee.Flat != 0 && fee.BasisPoints != 0 {
+		return errors.New("The " + kind + " fee must be either a flat amount or basis points")
+	}
+	return nil
+}
+
+// takeFee moves the fee in the record from the payer to the operator.
+// Nothing is written.
+func takeFee(record FeeRecord, payer *Account, operator *Account) error {
+	now, err := msToTime(record.Timestamp)
+	if err != nil {
+		return errors.New("Invalid fee timestamp " + record.Timestamp)
+	}
+	if availableCash(*payer, record.Currency, now) < record.Amount {
+		fmt.Println("The company " + payer.ID + " can't pay the " + record.Kind + " fee")
+		return errors.New("The company " + payer.ID + " doesn't have enough " + record.Currency + " cash to pay the " + record.Kind + " fee of " + record.Amount.String())
+	}
+	addCash(payer, record.Currency, -record.Amount)
+	addCash(operator, record.Currency, record.Amount)
+	return nil
+}
+
+// chargeFee takes the fee in the record from the payer and credits it to
+// the operator. Accounts the caller has loaded and will write back are
+// passed in loaded, so a credit to one of them isn't lost; otherwise the
+// operator account is written here. The fee is recorded under its ID.
+func chargeFee(stub shim.ChaincodeStubInterface, schedule FeeSchedule, record FeeRecord, payer *Account, loaded ...*Account) error {
+	if record.Amount == 0 {
+		return nil
+	}
+	record.Operator = schedule.Operator
+
+	var operator *Account
+	for _, account := range append(loaded, payer) {
+		if account.ID == schedule.Operator {
+			operator = account
+			break
+		}
+	}
+	if operator != nil {
+		err := takeFee(record, payer, operator)
+		if err != nil {
+			return err
+		}
+	} else {
+		account, err := GetCompany(schedule.Operator, stub)
+		if err != nil {
+			return err
+		}
+		err = takeFee(record, payer, &account)
+		if err != nil {
+			return err
+		}
+		err = putCompany(stub, account)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := putFeeRecord(stub, record)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Charged " + record.Payer + " a " + record.Kind + " fee of " + record.Amount.String() + " " + record.Currency)
+	return nil
+}
+
+func GetFeeRecord(recordID string, stub shim.ChaincodeStubInterface) (FeeRecord, error) {
+	var record FeeRecord
+
+	recordBytes, err := stub.GetState(feePrefix + recordID)
+	if err != nil || recordBytes == nil {
+		fmt.Println("Fee not found " + recordID)
+		return record, errors.New("Fee not found " + recordID)
+	}
+
+	err = json.Unmarshal(recordBytes, &record)
+	if err != nil {
+		fmt.Println("Error unmarshalling fee " + recordID)
+		return record, errors.New("Error unmarshalling fee " + recordID)
+	}
+
+	return record, nil
+}
+
+func putFeeRecord(stub shim.ChaincodeStubInterface, record FeeRecord) error {
+	recordBytes, err := json.Marshal(&record)
+	if err != nil {
+		fmt.Println("Error marshalling fee " + record.ID)
+		return errors.New("Error marshalling fee " + record.ID)
+	}
+	err = stub.PutState(feePrefix + record.ID, recordBytes)
+	if err != nil {
+		fmt.Println("Error writing fee " + record.ID)
+		return errors.New("Error writing fee " + record.ID)
+	}
+
+	return nil
+}
+
+// chargeIssuanceFee charges the issuer the issuance fee on the face value of
+// a new issue, once any primary sale has settled
+func chargeIssuanceFee(stub shim.ChaincodeStubInterface, cp CP, now time.Time) error {
+	schedule, err := GetFeeSchedule(stub)
+	if err != nil {
+		return err
+	}
+	// Fees on the trades of a primary sale in the same transaction are
+	// recorded under the trade IDs, so the issuance fee is kept apart by
+	// its kind
+	face := cp.Par * Money(cp.Qty)
+	record := FeeRecord{
+		ID:        issuanceFee + "-" + stub.GetTxID(),
+		Kind:      issuanceFee,
+		Payer:     cp.Issuer,
+		CUSIP:     cp.CUSIP,
+		Currency:  paperCurrency(cp),
+		Basis:     face,
+		Amount:    schedule.Issuance.amount(face),
+		Timestamp: timeToMs(now),
+	}
+	if record.Amount == 0 {
+		return nil
+	}
+
+	issuer, err := GetCompany(cp.Issuer, stub)
+	if err != nil {
+		return err
+	}
+	err = chargeFee(stub, schedule, record, &issuer)
+	if err != nil {
+		return err
+	}
+	return putCompany(stub, issuer)
+}
+
+// GetFees totals the fees collected per paying account and period. The
+// optional args restrict the fees to one account and a time range, and set
+// the period to "day", "month" or "all".
+func GetFees(args []string, stub shim.ChaincodeStubInterface) ([]FeeTotal, error) {
+	totals := []FeeTotal{}
+
+	/*		0			1			2			3
+		account		from (ms)	to (ms)		period
+	*/
+	if len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting optional account, from, to and period")
+	}
+	for len(args) < 4 {
+		args = append(args, "")
+	}
+	account := args[0]
+	var from, to time.Time
+	var err error
+	if args[1] != "" {
+		from, err = msToTime(args[1])
+		if err != nil {
+			return nil, errors.New("Invalid from date " + args[1])
+		}
+	}
+	if args[2] != "" {
+		to, err = msToTime(args[2])
+		if err != nil {
+			return nil, errors.New("Invalid to date " + args[2])
+		}
+	}
+	var layout string
+	switch args[3] {
+	case "", "day":
+		layout = "2006-01-02"
+	case "month":
+		layout = "2006-01"
+	case "all":
+	default:
+		return nil, errors.New("Unknown period " + args[3])
+	}
+
+	iter, err := stub.RangeQueryState(feePrefix, feePrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading fees")
+		return nil, errors.New("Error reading fees: " + err.Error())
+	}
+	defer iter.Close()
+
+	index := make(map[string]int)
+	for iter.HasNext() {
+		key, recordBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading fees: " + err.Error())
+		}
+		var record FeeRecord
+		err = json.Unmarshal(recordBytes, &record)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		if account != "" && record.Payer != account {
+			continue
+		}
+		charged, err := msToTime(record.Timestamp)
+		if err != nil {
+			return nil, errors.New("Invalid timestamp on " + key)
+		}
+		if (args[1] != "" && charged.Before(from)) || (args[2] != "" && !charged.Before(to)) {
+			continue
+		}
+
+		period := ""
+		if layout != "" {
+			period = charged.UTC().Format(layout)
+		}
+		group := record.Payer + "|" + period + "|" + record.Currency
+		i, ok := index[group]
+		if !ok {
+			i = len(totals)
+			index[group] = i
+			totals = append(totals, FeeTotal{Account: record.Payer, Period: period, Currency: record.Currency})
+		}
+		totals[i].Count++
+		totals[i].Amount += record.Amount
+	}
+
+	sort.Sort(feeTotals(totals))
+	return totals, nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFeesGoToTheOperator(t *testing.T) {
+	cc, stub := newTestStub(t)
+	schedule := toJSON(t, map[string]interface{}{
+		"operator": "company5",
+		"issuance": map[string]interface{}{"basisPoints": 5},
+		"transfer": map[string]interface{}{"flat": 25.00},
+	})
+
+	// Only an admin sets the schedule
+	for _, caller := range []string{"company1", "company5", ""} {
+		_, err := invoke(stub, cc, caller, "setFeeSchedule", schedule)
+		if err == nil {
+			t.Errorf("%q set the fee schedule", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, testAdmin, "setFeeSchedule", schedule)
+
+	cusip := issueTestPaper(t, stub, cc, nil)
+	var proposal Proposal
+	err := json.Unmarshal(mustInvoke(t, stub, cc, "company1", "transferPaper", toJSON(t, map[string]interface{}{
+		"CUSIP":       cusip,
+		"fromCompany": "company1",
+		"toCompany":   "company2",
+		"quantity":    3,
+	})), &proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptTransfer", proposal.ID)
+
+	// 5bp on the 10,000.00 issued and the flat fee on the transfer
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 7, "company2": 3})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance - 500 + 299100 - 2500,
+		"company2": initialCashBalance - 299100,
+		"company5": initialCashBalance + 500 + 2500,
+	})
+	var totals []FeeTotal
+	result, err := query(stub, cc, "company1", "GetFees", "company1", "", "", "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(result, &totals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Count != 2 || totals[0].Amount != 3000 {
+		t.Errorf("company1 paid %+v, want 2 fees of 30.00 in all", totals)
+	}
+}
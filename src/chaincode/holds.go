@@ -0,0 +1,450 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var holdPrefix = "hold:"
+
+// Hold status values. A hold past its expiry no longer reserves anything
+// and is shown as expired.
+const (
+	holdActive   = "active"
+	holdReleased = "released"
+	holdConsumed = "consumed"
+	holdExpired  = "expired"
+)
+
+// Hold reserves a quantity of a paper or an amount of cash in one currency
+// for a settlement until it expires. A hold is released, or consumed whole
+// by a transfer that names it in its holds.
+type Hold struct {
+	ID        string `json:"id"`
+	Company   string `json:"company"`
+	CUSIP     string `json:"cusip,omitempty"`
+	Quantity  int    `json:"quantity,omitempty"`
+	Currency  string `json:"currency,omitempty"`
+	Amount    Money  `json:"amount,omitempty"`
+	Reason    string `json:"reason"`
+	Expiry    string `json:"expiry"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	TradeID   string `json:"tradeId,omitempty"`
+	Ended     string `json:"ended,omitempty"`
+}
+
+// HoldEntry is a hold as it is kept on the owner of the paper or the
+// account it reserves, so what is available can be worked out without
+// reading the holds themselves
+type HoldEntry struct {
+	ID       string `json:"id"`
+	Quantity int    `json:"quantity,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	Amount   Money  `json:"amount,omitempty"`
+	Expiry   string `json:"expiry"`
+}
+
+// available returns the quantity of the paper the company holds and is free
+// to deliver on the given date, which leaves out collateral it holds under a
+// repo and anything on hold
+func available(cp CP, company string, now time.Time) int {
+	for _, owner := range cp.Owners {
+		if owner.Company == company {
+			free := owner.Quantity - owner.Encumbered
+			for _, entry := range owner.Holds {
+				if !pastExpiry(entry.Expiry, now) {
+					free -= entry.Quantity
+				}
+			}
+			return free
+		}
+	}
+	return 0
+}
+
+// availableCash returns the account's cash in the currency that isn't on
+// hold on the given date
+func availableCash(account Account, currency string, now time.Time) Money {
+	free := cashBalance(account, currency)
+	for _, entry := range account.Holds {
+		if entry.Currency == currency && !pastExpiry(entry.Expiry, now) {
+			free -= entry.Amount
+		}
+	}
+	return free
+}
+
+// heldFor returns the quantity of the paper the company has on the named
+// holds that are still active on the given date
+func heldFor(cp CP, company string, holdIDs []string, now time.Time) int {
+	held := 0
+	for _, owner := range cp.Owners {
+		if owner.Company != company {
+			continue
+		}
+		for _, entry := range owner.Holds {
+			for _, id := range holdIDs {
+				if entry.ID == id && !pastExpiry(entry.Expiry, now) {
+					held += entry.Quantity
+				}
+			}
+		}
+	}
+	return held
+}
+
+// removeHoldEntry drops a hold from a list of entries and reports whether
+// it was there
+func removeHoldEntry(entries []HoldEntry, holdID string) ([]HoldEntry, HoldEntry, bool) {
+	for i, entry := range entries {
+		if entry.ID == holdID {
+			return append(entries[:i], entries[i + 1:]...), entry, true
+		}
+	}
+	return entries, HoldEntry{}, false
+}
+
+// pruneHoldEntries drops entries past their expiry
+func pruneHoldEntries(entries []HoldEntry, now time.Time) []HoldEntry {
+	var kept []HoldEntry
+	for _, entry := range entries {
+		if !pastExpiry(entry.Expiry, now) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// consumeHoldEntries takes the holds a transfer names off the seller's
+// position and the buyer's account, so what they reserved can be used by
+// the transfer. Each hold must be active and belong to one of the two.
+func consumeHoldEntries(cp *CP, fromCompany *Account, toCompany *Account, holdIDs []string, now time.Time) error {
+	for _, id := range holdIDs {
+		var entry HoldEntry
+		found := false
+		for key, owner := range cp.Owners {
+			if owner.Company == fromCompany.ID && !found {
+				cp.Owners[key].Holds, entry, found = removeHoldEntry(owner.Holds, id)
+			}
+		}
+		if !found {
+			toCompany.Holds, entry, found = removeHoldEntry(toCompany.Holds, id)
+			if found && entry.Currency != paperCurrency(*cp) {
+				return errors.New("Hold " + id + " is on " + entry.Currency + " cash, the paper " + cp.CUSIP + " settles in " + paperCurrency(*cp))
+			}
+		}
+		if !found {
+			fmt.Println("Hold " + id + " isn't on either side of the transfer")
+			return errors.New("Hold " + id + " isn't held by " + fromCompany.ID + " on " + cp.CUSIP + " or by " + toCompany.ID + " on cash")
+		}
+		if pastExpiry(entry.Expiry, now) {
+			return errors.New("Hold " + id + " has expired")
+		}
+	}
+	return nil
+}
+
+// markHoldsConsumed records that the holds were consumed by a trade
+func markHoldsConsumed(stub shim.ChaincodeStubInterface, holdIDs []string, tradeID string, ended string) error {
+	for _, id := range holdIDs {
+		hold, err := GetHold(id, stub)
+		if err != nil {
+			return err
+		}
+		hold.Status = holdConsumed
+		hold.TradeID = tradeID
+		hold.Ended = ended
+		err = putHold(stub, hold)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetHold(holdID string, stub shim.ChaincodeStubInterface) (Hold, error) {
+	var hold Hold
+
+	holdBytes, err := stub.GetState(holdPrefix + holdID)
+	if err != nil || holdBytes == nil {
+		fmt.Println("Hold not found " + holdID)
+		return hold, errors.New("Hold not found " + holdID)
+	}
+
+	err = json.Unmarshal(holdBytes, &hold)
+	if err != nil {
+		fmt.Println("Error unmarshalling hold " + holdID)
+		return hold, errors.New("Error unmarshalling hold " + holdID)
+	}
+
+	return hold, nil
+}
+
+func putHold(stub shim.ChaincodeStubInterface, hold Hold) error {
+	holdBytes, err := json.Marshal(&hold)
+	if err != nil {
+		fmt.Println("Error marshalling hold " + hold.ID)
+		return errors.New("Error marshalling hold " + hold.ID)
+	}
+	err = stub.PutState(holdPrefix + hold.ID, holdBytes)
+	if err != nil {
+		fmt.Println("Error writing hold " + hold.ID + " back")
+		return errors.New("Error writing hold " + hold.ID + " back")
+	}
+
+	return nil
+}
+
+// expireHold marks an active hold expired once its expiry has passed
+func expireHold(hold *Hold, now time.Time) {
+	if hold.Status == holdActive && pastExpiry(hold.Expiry, now) {
+		hold.Status = holdExpired
+	}
+}
+
+func (t *SimpleChaincode) placeHold(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Placing hold")
+	/*		0
+		json
+	  	{
+			"cusip": "",  (with quantity, for a hold on paper)
+			"quantity": 5,
+			"currency": "USD",  (with amount, for a hold on cash)
+			"amount": 1000.00,
+			"reason": "string",
+			"expiry": "1456161763790"  (time in milliseconds the hold lapses)
+		}
+	*/
+	// A company can only put its own paper or cash on hold
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting hold")
+	}
+
+	var hold Hold
+	err := json.Unmarshal([]byte(args[0]), &hold)
+	if err != nil {
+		fmt.Println("Error unmarshalling hold")
+		return nil, errors.New("Invalid hold")
+	}
+	hold.Company, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	onPaper := hold.CUSIP != "" || hold.Quantity != 0
+	onCash := hold.Currency != "" || hold.Amount != 0
+	if onPaper == onCash {
+		return nil, errors.New("A hold must be on either a quantity of paper or an amount of cash")
+	}
+	if onPaper && hold.Quantity <= 0 {
+		return nil, errors.New("Hold quantity must be positive")
+	}
+	if onCash && hold.Amount <= 0 {
+		return nil, errors.New("Hold amount must be positive")
+	}
+	if hold.Reason == "" {
+		return nil, errors.New("A hold needs a reason")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	expiry, err := msToTime(hold.Expiry)
+	if err != nil {
+		return nil, errors.New("Invalid hold expiry " + hold.Expiry)
+	}
+	if !expiry.After(now) {
+		return nil, errors.New("Hold expiry must be in the future")
+	}
+
+	account, err := GetCompany(hold.Company, stub)
+	if err != nil {
+		return nil, err
+	}
+	hold.ID = stub.GetTxID()
+	hold.Expiry = timeToMs(expiry)
+	hold.Status = holdActive
+	hold.Timestamp = timeToMs(now)
+	hold.TradeID = ""
+	hold.Ended = ""
+	entry := HoldEntry{ID: hold.ID, Quantity: hold.Quantity, Currency: hold.Currency, Amount: hold.Amount, Expiry: hold.Expiry}
+
+	// Only what is free can be put on hold
+	if onPaper {
+		cp, err := GetCP(cpPrefix + hold.CUSIP, stub)
+		if err != nil {
+			return nil, err
+		}
+		if available(cp, hold.Company, now) < hold.Quantity {
+			fmt.Println("The company " + hold.Company + " doesn't have enough of " + hold.CUSIP + " free to hold")
+			return nil, errors.New("The company " + hold.Company + " doesn't have enough of " + hold.CUSIP + " free to put on hold")
+		}
+		for key, owner := range cp.Owners {
+			if owner.Company == hold.Company {
+				cp.Owners[key].Holds = append(pruneHoldEntries(owner.Holds, now), entry)
+			}
+		}
+		err = putCP(stub, cp)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !validCurrency(hold.Currency) {
+			return nil, errors.New("Invalid currency " + hold.Currency)
+		}
+		if availableCash(account, hold.Currency, now) < hold.Amount {
+			fmt.Println("The company " + hold.Company + " doesn't have enough cash free to hold")
+			return nil, errors.New("The company " + hold.Company + " doesn't have enough " + hold.Currency + " cash free to put on hold")
+		}
+		account.Holds = append(pruneHoldEntries(account.Holds, now), entry)
+		err = putCompany(stub, account)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = putHold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Placed hold " + hold.ID + " for " + hold.Company)
+	return []byte(hold.ID), nil
+}
+
+func (t *SimpleChaincode) releaseHold(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Releasing hold")
+	/*		0
+		hold ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting hold ID")
+	}
+
+	// Only the company the hold is on can release it
+	company, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := GetHold(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+	if hold.Company != company {
+		fmt.Println("Hold " + hold.ID + " doesn't belong to " + company)
+		return nil, errors.New("Hold " + hold.ID + " doesn't belong to " + company)
+	}
+	if hold.Status != holdActive {
+		fmt.Println("Hold " + hold.ID + " is " + hold.Status)
+		return nil, errors.New("Hold " + hold.ID + " is " + hold.Status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	if hold.CUSIP != "" {
+		cp, err := GetCP(cpPrefix + hold.CUSIP, stub)
+		if err != nil {
+			return nil, err
+		}
+		for key, owner := range cp.Owners {
+			if owner.Company == hold.Company {
+				cp.Owners[key].Holds, _, _ = removeHoldEntry(owner.Holds, hold.ID)
+			}
+		}
+		err = putCP(stub, cp)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		account, err := GetCompany(hold.Company, stub)
+		if err != nil {
+			return nil, err
+		}
+		account.Holds, _, _ = removeHoldEntry(account.Holds, hold.ID)
+		err = putCompany(stub, account)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A hold that lapsed before it was released keeps its expired status
+	expireHold(&hold, now)
+	if hold.Status == holdActive {
+		hold.Status = holdReleased
+	}
+	hold.Ended = timeToMs(now)
+	err = putHold(stub, hold)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Released hold " + hold.ID)
+	return nil, nil
+}
+
+// GetHolds returns the company's holds, only active ones unless all is set
+func GetHolds(companyID string, all bool, stub shim.ChaincodeStubInterface) ([]Hold, error) {
+	holds := []Hold{}
+
+	iter, err := stub.RangeQueryState(holdPrefix, holdPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading holds")
+		return nil, errors.New("Error reading holds: " + err.Error())
+	}
+	defer iter.Close()
+
+	now, timeErr := txTime(stub)
+	for iter.HasNext() {
+		key, holdBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading holds: " + err.Error())
+		}
+		var hold Hold
+		err = json.Unmarshal(holdBytes, &hold)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		if hold.Company != companyID {
+			continue
+		}
+		if timeErr == nil {
+			expireHold(&hold, now)
+		}
+		if !all && hold.Status != holdActive {
+			continue
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, nil
+}
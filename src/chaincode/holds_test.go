@@ -0,0 +1,74 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHoldsBelongToTheCaller(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	hold := toJSON(t, map[string]interface{}{
+		"cusip":    cusip,
+		"quantity": 8,
+		"reason":   "pledged",
+		"expiry":   ms(stub.now.Add(time.Hour)),
+	})
+
+	// The hold is on the caller's own paper
+	_, err := invoke(stub, cc, "company2", "placeHold", hold)
+	if err == nil {
+		t.Error("company2 put paper it doesn't hold on hold")
+	}
+	holdID := string(mustInvoke(t, stub, cc, "company1", "placeHold", hold))
+	transfer := toJSON(t, map[string]interface{}{
+		"CUSIP":       cusip,
+		"fromCompany": "company1",
+		"toCompany":   "company2",
+		"quantity":    3,
+	})
+	_, err = invoke(stub, cc, "company1", "transferPaper", transfer)
+	if err == nil {
+		t.Error("paper on hold was offered for transfer")
+	}
+
+	// Only the company the hold is on can release it
+	for _, caller := range []string{"company2", ""} {
+		_, err := invoke(stub, cc, caller, "releaseHold", holdID)
+		if err == nil {
+			t.Errorf("%q released company1's hold", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company1", "releaseHold", holdID)
+
+	var proposal Proposal
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company1", "transferPaper", transfer), &proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptTransfer", proposal.ID)
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 7, "company2": 3})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 299100,
+		"company2": initialCashBalance - 299100,
+	})
+}
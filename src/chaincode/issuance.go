@@ -0,0 +1,334 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var issuanceLimitsKey = "IssuanceLimits"
+
+// Commercial paper is only exempt from registration for maturities up to
+// 270 days
+const (
+	minMaturityDays = 1
+	maxMaturityDays = 270
+)
+
+// issueDateSkew is how far an issue date may run ahead of the transaction
+// timestamp, to allow for clocks on the client and the peer disagreeing
+const issueDateSkew = 5 * time.Minute
+
+// Each issuance rule has its own error so the UI can tell them apart
+var (
+	errMaturityRange  = errors.New("Maturity must be between " + strconv.Itoa(minMaturityDays) + " and " + strconv.Itoa(maxMaturityDays) + " days")
+	errParNotPositive = errors.New("Par value must be positive")
+	errQtyNotPositive = errors.New("Quantity must be positive")
+	errIssueDate      = errors.New("Issue date is not a valid time in milliseconds")
+	errIssueDateAhead = errors.New("Issue date can't be in the future")
+)
+
+// IssuanceLimits holds the configurable bounds checked at issuance
+type IssuanceLimits struct {
+	MinDiscount     Rate `json:"minDiscount"`
+	MaxDiscount     Rate `json:"maxDiscount"`
+	MaxIssueAgeDays int     `json:"maxIssueAgeDays"`
+}
+
+var defaultIssuanceLimits = IssuanceLimits{MinDiscount: 0, MaxDiscount: 20 * rateScale, MaxIssueAgeDays: 7}
+
+// GetIssuanceLimits returns the stored issuance limits, or the defaults if
+// none have been set
+func GetIssuanceLimits(stub shim.ChaincodeStubInterface) (IssuanceLimits, error) {
+	limits := defaultIssuanceLimits
+
+	limitsBytes, err := stub.GetState(issuanceLimitsKey)
+	if err != nil {
+		fmt.Println("Error retrieving issuance limits")
+		return limits, errors.New("Error retrieving issuance limits")
+	}
+	if limitsBytes == nil {
+		return limits, nil
+	}
+
+	err = json.Unmarshal(limitsBytes, &limits)
+	if err != nil {
+		fmt.Println("Error unmarshalling issuance limits")
+		return limits, errors.New("Error unmarshalling issuance limits")
+	}
+
+	return limits, nil
+}
+
+func (t *SimpleChaincode) setIssuanceLimits(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Setting issuance limits")
+	/*		0
+		json
+	  	{
+			"minDiscount": 0.0,
+			"maxDiscount": 20.0,
+			"maxIssueAgeDays": 7
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting issuance limits")
+	}
+
+	var limits IssuanceLimits
+	err := json.Unmarshal([]byte(args[0]), &limits)
+	if err != nil {
+		fmt.Println("Error unmarshalling issuance limits")
+		return nil, errors.New("Invalid issuance limits")
+	}
+	if limits.MinDiscount < 0 || limits.MaxDiscount < limits.MinDiscount {
+		return nil, errors.New("Discount band must satisfy 0 <= minDiscount <= maxDiscount")
+	}
+	if limits.MaxIssueAgeDays < 0 {
+		return nil, errors.New("maxIssueAgeDays can't be negative")
+	}
+
+	limitsBytes, err := json.Marshal(&limits)
+	if err != nil {
+		fmt.Println("Error marshalling issuance limits")
+		return nil, errors.New("Error marshalling issuance limits")
+	}
+	err = stub.PutState(issuanceLimitsKey, limitsBytes)
+	if err != nil {
+		fmt.Println("Error writing issuance limits")
+		return nil, errors.New("Error writing issuance limits")
+	}
+
+	fmt.Println("Issuance limits set")
+	return nil, nil
+}
+
+// validateIssue checks the terms of a new issue against the issuance rules
+// and returns the first one it breaks
+func validateIssue(cp CP, limits IssuanceLimits, now time.Time) error {
+	if cp.Maturity < minMaturityDays || cp.Maturity > maxMaturityDays {
+		return errMaturityRange
+	}
+	if cp.Par <= 0 {
+		return errParNotPositive
+	}
+	if cp.Qty <= 0 {
+		return errQtyNotPositive
+	}
+	if cp.Discount < limits.MinDiscount || cp.Discount > limits.MaxDiscount {
+		return errors.New("Discount must be between " + limits.MinDiscount.String() + "% and " + limits.MaxDiscount.String() + "%")
+	}
+
+	issueDate, err := msToTime(cp.IssueDate)
+	if err != nil {
+		return errIssueDate
+	}
+	if issueDate.After(now.Add(issueDateSkew)) {
+		return errIssueDateAhead
+	}
+	if issueDate.Before(now.AddDate(0, 0, -limits.MaxIssueAgeDays)) {
+		return errors.New("Issue date can't be more than " + strconv.Itoa(limits.MaxIssueAgeDays) + " days in the past")
+	}
+
+	return nil
+}
+
+// primarySale is a checked sale of newly issued paper to investors
+type primarySale struct {
+	allocations []Owner
+	investors   []Account
+	amounts     []Money
+}
+
+// planPrimarySale checks that the issuer holds enough of the paper for the
+// allocations and that every investor can pay for theirs at the issuance
+// discount on the given settlement date. Nothing is written.
+func planPrimarySale(stub shim.ChaincodeStubInterface, cp CP, allocations []Owner, settle time.Time) (primarySale, error) {
+	var sale primarySale
+
+	// Merge repeated investors so each one is settled once
+	for _, allocation := range allocations {
+		if allocation.Quantity <= 0 {
+			return sale, errors.New("Allocation to " + allocation.Company + " must have a positive quantity")
+		}
+		if allocation.Company == cp.Issuer {
+			return sale, errors.New("The issuer " + cp.Issuer + " can't be allocated its own paper")
+		}
+		merged := false
+		for key := range sale.allocations {
+			if sale.allocations[key].Company == allocation.Company {
+				sale.allocations[key].Quantity += allocation.Quantity
+				merged = true
+			}
+		}
+		if !merged {
+			sale.allocations = append(sale.allocations, allocation)
+		}
+	}
+
+	issuerQuantity := available(cp, cp.Issuer, settle)
+	allocated := 0
+	for _, allocation := range sale.allocations {
+		allocated += allocation.Quantity
+	}
+	if allocated > issuerQuantity {
+		fmt.Println("Allocations exceed the issuer's holding of " + cp.CUSIP)
+		return sale, errors.New("Allocations of " + strconv.Itoa(allocated) + " exceed the " + strconv.Itoa(issuerQuantity) + " held by the issuer")
+	}
+
+	for _, allocation := range sale.allocations {
+		investor, err := GetCompany(allocation.Company, stub)
+		if err != nil {
+			return sale, err
+		}
+		amount, err := paperPrice(cp, allocation.Quantity, cp.Discount, settle)
+		if err != nil {
+			return sale, err
+		}
+		if availableCash(investor, paperCurrency(cp), settle) < amount {
+			fmt.Println("The company " + investor.ID + " doesn't have enough cash for its allocation")
+			return sale, errors.New("The company " + investor.ID + " doesn't have enough " + paperCurrency(cp) + " cash to purchase its allocation")
+		}
+		sale.investors = append(sale.investors, investor)
+		sale.amounts = append(sale.amounts, amount)
+	}
+
+	return sale, nil
+}
+
+// settlePrimarySale moves the allocated quantity from the issuer to the
+// investors and their cash to the issuer
+func settlePrimarySale(stub shim.ChaincodeStubInterface, cusip string, sale primarySale) error {
+	if len(sale.allocations) == 0 {
+		return nil
+	}
+
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		return err
+	}
+	issuer, err := GetCompany(cp.Issuer, stub)
+	if err != nil {
+		return err
+	}
+
+	currency := paperCurrency(cp)
+	for i, allocation := range sale.allocations {
+		investor := sale.investors[i]
+		addCash(&investor, currency, -sale.amounts[i])
+		addCash(&issuer, currency, sale.amounts[i])
+
+		investorFound := false
+		for key, owner := range cp.Owners {
+			if owner.Company == cp.Issuer {
+				cp.Owners[key].Quantity -= allocation.Quantity
+			}
+			if owner.Company == allocation.Company {
+				investorFound = true
+				cp.Owners[key].Quantity += allocation.Quantity
+			}
+		}
+		if !investorFound {
+			cp.Owners = append(cp.Owners, allocation)
+		}
+
+		investor.AssetsIds = append(investor.AssetsIds, cusip)
+		err = putCompany(stub, investor)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Allocated %d of %s to %s for %s %s\n", allocation.Quantity, cusip, allocation.Company, sale.amounts[i], currency)
+	}
+
+	err = putCompany(stub, issuer)
+	if err != nil {
+		return err
+	}
+	return putCP(stub, cp)
+}
+
+func (t *SimpleChaincode) allocatePaper(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Allocating paper")
+	/*		0
+		json
+	  	{
+			"cusip": "",
+			"allocations": [
+				{
+					"company": "company1",
+					"quantity": 5
+				}
+			]
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting allocation record")
+	}
+
+	var request struct {
+		CUSIP       string  `json:"cusip"`
+		Allocations []Owner `json:"allocations"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		fmt.Println("Error unmarshalling allocation")
+		return nil, errors.New("Invalid allocation record")
+	}
+	if len(request.Allocations) == 0 {
+		return nil, errors.New("No allocations given")
+	}
+
+	cp, err := GetCP(cpPrefix + request.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Status == paperMatured || cp.Status == paperDefaulted {
+		fmt.Println("The paper " + request.CUSIP + " is " + cp.Status)
+		return nil, errors.New("The paper " + request.CUSIP + " is " + cp.Status + " and can't be allocated")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	_, err = daysToMaturity(cp, now)
+	if err != nil {
+		return nil, err
+	}
+
+	sale, err := planPrimarySale(stub, cp, request.Allocations, now)
+	if err != nil {
+		return nil, err
+	}
+	err = settlePrimarySale(stub, request.CUSIP, sale)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Successfully allocated " + request.CUSIP)
+	return nil, nil
+}
@@ -0,0 +1,668 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var loanPrefix = "loan:"
+
+// Loan status values, a loan is offered by the lender and opens when the
+// borrower accepts it. Offered loans also use the proposal status values.
+const (
+	loanOpen     = "open"
+	loanReturned = "returned"
+	loanRecalled = "recalled"
+	loanMatured  = "matured"
+)
+
+// Loan is a loan of paper from the lender to the borrower against cash
+// collateral the lender holds. The quantity moves to the borrower, who may
+// sell it, but the lender keeps the economics: whatever the paper pays while
+// it is lent is owed to the lender as income. The fee accrues daily at the
+// fee rate on the collateral, on an ACT/360 basis, and everything the
+// borrower owes is netted against the collateral when the loan ends.
+type Loan struct {
+	ID         string `json:"id"`
+	CUSIP      string `json:"cusip"`
+	Lender     string `json:"lender"`
+	Borrower   string `json:"borrower"`
+	Quantity   int    `json:"quantity"`
+	Collateral Money  `json:"collateral"`
+	FeeRate    Rate   `json:"feeRate"`
+	Currency   string `json:"currency"`
+	Status     string `json:"status"`
+	Timestamp  string `json:"timestamp"`
+	Expiry     string `json:"expiry,omitempty"`
+	Start      string `json:"start,omitempty"`
+	// Accrued is the fee owed so far, or the fee paid once the loan ends
+	Accrued    Money  `json:"accrued,omitempty"`
+	Income     Money  `json:"income,omitempty"`
+	// BuyIn is what the lender was paid for paper that wasn't handed back
+	BuyIn      Money  `json:"buyIn,omitempty"`
+	// Shortfall is what the borrower couldn't pay when the paper matured
+	Shortfall  Money  `json:"shortfall,omitempty"`
+	Ended      string `json:"ended,omitempty"`
+}
+
+// minCollateral is the least collateral a loan can be opened against, as a
+// percentage of what the lent paper is worth
+var minCollateral = Rate(102 * rateScale)
+
+// LoanBook is a company's outstanding loans as lender and as borrower
+type LoanBook struct {
+	Company  string `json:"company"`
+	Lent     []Loan `json:"lent"`
+	Borrowed []Loan `json:"borrowed"`
+}
+
+// loanFee returns the fee accrued on the loan for each whole day from its
+// start to the given date
+func loanFee(loan Loan, now time.Time) (Money, error) {
+	start, err := msToTime(loan.Start)
+	if err != nil {
+		return 0, errors.New("Invalid start date on loan " + loan.ID)
+	}
+	days := calendarDays(start, now)
+	if days < 0 {
+		days = 0
+	}
+	fee := new(big.Rat).Mul(loan.Collateral.rat(), loan.FeeRate.fraction())
+	fee.Mul(fee, big.NewRat(int64(days), 360))
+	return moneyFromRat(fee), nil
+}
+
+// buyInValue returns what quantity units of the paper are worth on the
+// given date, for paper the borrower can't hand back
+func buyInValue(cp CP, quantity int, now time.Time) (Money, error) {
+	value, err := maturityValue(cp)
+	if err != nil {
+		return 0, err
+	}
+	if cp.Status == paperDefaulted {
+		return (value - cp.Recovered) * Money(quantity), nil
+	}
+	if _, err := daysToMaturity(cp, now); err != nil {
+		return value * Money(quantity), nil
+	}
+	return paperPrice(cp, quantity, cp.Discount, now)
+}
+
+// checkCollateral makes sure the loan's collateral covers the lent paper by
+// the minimum margin on the given date
+func checkCollateral(cp CP, loan Loan, now time.Time) error {
+	value, err := buyInValue(cp, loan.Quantity, now)
+	if err != nil {
+		return err
+	}
+	required := moneyFromRat(new(big.Rat).Mul(value.rat(), minCollateral.fraction()))
+	if loan.Collateral < required {
+		fmt.Println("Loan collateral doesn't cover the paper lent")
+		return errors.New("Loan collateral of " + loan.Collateral.String() + " is below the " + required.String() + " needed, " + minCollateral.String() + "% of what the paper is worth")
+	}
+
+	return nil
+}
+
+func GetLoan(loanID string, stub shim.ChaincodeStubInterface) (Loan, error) {
+	var loan Loan
+
+	loanBytes, err := stub.GetState(loanPrefix + loanID)
+	if err != nil || loanBytes == nil {
+		fmt.Println("Loan not found " + loanID)
+		return loan, errors.New("Loan not found " + loanID)
+	}
+
+	err = json.Unmarshal(loanBytes, &loan)
+	if err != nil {
+		fmt.Println("Error unmarshalling loan " + loanID)
+		return loan, errors.New("Error unmarshalling loan " + loanID)
+	}
+
+	return loan, nil
+}
+
+func putLoan(stub shim.ChaincodeStubInterface, loan Loan) error {
+	loanBytes, err := json.Marshal(&loan)
+	if err != nil {
+		fmt.Println("Error marshalling loan " + loan.ID)
+		return errors.New("Error marshalling loan " + loan.ID)
+	}
+	err = stub.PutState(loanPrefix + loan.ID, loanBytes)
+	if err != nil {
+		fmt.Println("Error writing loan " + loan.ID + " back")
+		return errors.New("Error writing loan " + loan.ID + " back")
+	}
+
+	return nil
+}
+
+// getLoans returns every loan in key order
+func getLoans(stub shim.ChaincodeStubInterface) ([]Loan, error) {
+	var loans []Loan
+
+	iter, err := stub.RangeQueryState(loanPrefix, loanPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading loans")
+		return nil, errors.New("Error reading loans: " + err.Error())
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		key, loanBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading loans: " + err.Error())
+		}
+		var loan Loan
+		err = json.Unmarshal(loanBytes, &loan)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		loans = append(loans, loan)
+	}
+
+	return loans, nil
+}
+
+// expireLoan marks an offered loan expired once its expiry has passed
+func expireLoan(loan *Loan, now time.Time) {
+	if loan.Status == proposalPending && pastExpiry(loan.Expiry, now) {
+		loan.Status = proposalExpired
+	}
+}
+
+// endLoan settles an open loan with the given status. If deliver is set the
+// borrower hands the quantity back, otherwise the lender is paid buyIn for
+// it. The fee, any income and the buy in are netted against the collateral.
+// A borrower that can't pay its side fails the settlement, unless the paper
+// has matured, when it pays what it can and the rest is a shortfall.
+func endLoan(stub shim.ChaincodeStubInterface, loan *Loan, status string, deliver bool, buyIn Money, now time.Time) error {
+	fee, err := loanFee(*loan, now)
+	if err != nil {
+		return err
+	}
+	borrower, err := GetCompany(loan.Borrower, stub)
+	if err != nil {
+		return err
+	}
+	lender, err := GetCompany(loan.Lender, stub)
+	if err != nil {
+		return err
+	}
+
+	if deliver {
+		cp, err := GetCP(cpPrefix + loan.CUSIP, stub)
+		if err != nil {
+			return err
+		}
+		if available(cp, loan.Borrower, now) < loan.Quantity {
+			fmt.Println("The company " + loan.Borrower + " doesn't hold enough of " + loan.CUSIP + " to return")
+			return errors.New("The company " + loan.Borrower + " doesn't hold enough of " + loan.CUSIP + " to return loan " + loan.ID)
+		}
+		moveQuantity(&cp, loan.Borrower, loan.Lender, loan.Quantity)
+		err = putCP(stub, cp)
+		if err != nil {
+			return err
+		}
+	}
+
+	owed := fee + loan.Income + buyIn
+	net := loan.Collateral - owed
+	if net >= 0 {
+		if availableCash(lender, loan.Currency, now) < net {
+			fmt.Println("The company " + loan.Lender + " doesn't have the collateral to hand back")
+			return errors.New("The company " + loan.Lender + " doesn't have enough " + loan.Currency + " cash to hand back " + net.String() + " of collateral")
+		}
+	} else if availableCash(borrower, loan.Currency, now) < -net {
+		if status != loanMatured {
+			fmt.Println("The company " + loan.Borrower + " can't cover what it owes on the loan")
+			return errors.New("The company " + loan.Borrower + " doesn't have enough " + loan.Currency + " cash to pay " + (-net).String() + " owed on loan " + loan.ID)
+		}
+		paid := availableCash(borrower, loan.Currency, now)
+		if paid < 0 {
+			paid = 0
+		}
+		loan.Shortfall = -net - paid
+		net = -paid
+	}
+	addCash(&lender, loan.Currency, -net)
+	addCash(&borrower, loan.Currency, net)
+
+	loan.Status = status
+	loan.Accrued = fee
+	loan.BuyIn = buyIn
+	loan.Ended = timeToMs(now)
+
+	err = putCompany(stub, borrower)
+	if err != nil {
+		return err
+	}
+	err = putCompany(stub, lender)
+	if err != nil {
+		return err
+	}
+	err = putLoan(stub, *loan)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Loan " + loan.ID + " " + status + " with a fee of " + fee.String() + " " + loan.Currency)
+	return nil
+}
+
+// passLoanIncome records on every open loan of the paper what the paper
+// paid per unit, which the borrower owes the lender
+func passLoanIncome(stub shim.ChaincodeStubInterface, cp CP, perUnit Money) error {
+	loans, err := getLoans(stub)
+	if err != nil {
+		return err
+	}
+	for _, loan := range loans {
+		if loan.CUSIP != cp.CUSIP || loan.Status != loanOpen {
+			continue
+		}
+		loan.Income += perUnit * Money(loan.Quantity)
+		err = putLoan(stub, loan)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matureLoans ends every open loan of a redeemed paper. The lent paper has
+// been paid off, so the lender is paid the given value per unit instead of
+// getting it back.
+func matureLoans(stub shim.ChaincodeStubInterface, cp CP, value Money, now time.Time) error {
+	loans, err := getLoans(stub)
+	if err != nil {
+		return err
+	}
+	for _, loan := range loans {
+		if loan.CUSIP != cp.CUSIP || loan.Status != loanOpen {
+			continue
+		}
+		err = endLoan(stub, &loan, loanMatured, false, value * Money(loan.Quantity), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *SimpleChaincode) offerLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Offering loan")
+	/*		0
+		json
+	  	{
+			"cusip": "",
+			"borrower": "company2",
+			"quantity": 5,
+			"collateral": 5100.00, (at least 102% of what the paper is worth)
+			"feeRate": 0.5
+		}
+	*/
+	// The lender is the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting loan")
+	}
+
+	var loan Loan
+	err := json.Unmarshal([]byte(args[0]), &loan)
+	if err != nil {
+		fmt.Println("Error unmarshalling loan")
+		return nil, errors.New("Invalid loan")
+	}
+	loan.Lender, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if loan.Lender == loan.Borrower {
+		return nil, errors.New("The company " + loan.Lender + " can't lend paper to itself")
+	}
+	if loan.Quantity <= 0 {
+		return nil, errors.New("Loan quantity must be positive")
+	}
+	if loan.Collateral <= 0 {
+		return nil, errors.New("Loan collateral must be positive")
+	}
+	if loan.FeeRate < 0 || loan.FeeRate >= 100 * rateScale {
+		return nil, errors.New("Loan fee rate must be at least 0 and below 100")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	cp, err := tradeablePaper(stub, loan.CUSIP, now)
+	if err != nil {
+		return nil, err
+	}
+	if available(cp, loan.Lender, now) < loan.Quantity {
+		fmt.Println("The company " + loan.Lender + " doesn't have enough of " + loan.CUSIP + " to lend")
+		return nil, errors.New("The company " + loan.Lender + " doesn't have enough of " + loan.CUSIP + " to lend")
+	}
+	err = checkCollateral(cp, loan, now)
+	if err != nil {
+		return nil, err
+	}
+	_, err = GetCompany(loan.Borrower, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := GetProposalSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	loan.ID = stub.GetTxID()
+	loan.Currency = paperCurrency(cp)
+	loan.Status = proposalPending
+	loan.Timestamp = timeToMs(now)
+	loan.Expiry = timeToMs(now.Add(time.Duration(settings.ExpiryMinutes) * time.Minute))
+	loan.Start = ""
+	loan.Accrued = 0
+	loan.Income = 0
+	loan.BuyIn = 0
+	loan.Shortfall = 0
+	loan.Ended = ""
+	err = putLoan(stub, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Offered loan " + loan.ID + " of " + loan.CUSIP + " to " + loan.Borrower)
+	return json.Marshal(&loan)
+}
+
+// answerLoan loads an offered loan addressed to the caller that is still
+// pending on the given date. Only the borrower named in the caller's
+// certificate can answer it.
+func answerLoan(stub shim.ChaincodeStubInterface, loanID string, now time.Time) (Loan, error) {
+	borrower, err := callerCompany(stub)
+	if err != nil {
+		return Loan{}, err
+	}
+	loan, err := GetLoan(loanID, stub)
+	if err != nil {
+		return loan, err
+	}
+	if loan.Borrower != borrower {
+		fmt.Println("Loan " + loanID + " isn't offered to " + borrower)
+		return loan, errors.New("Loan " + loanID + " isn't offered to " + borrower)
+	}
+	expireLoan(&loan, now)
+	if loan.Status != proposalPending {
+		fmt.Println("Loan " + loanID + " is " + loan.Status)
+		return loan, errors.New("Loan " + loanID + " is " + loan.Status)
+	}
+
+	return loan, nil
+}
+
+func (t *SimpleChaincode) acceptLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting loan")
+	/*		0
+		loan ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting loan ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	loan, err := answerLoan(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := tradeablePaper(stub, loan.CUSIP, now)
+	if err != nil {
+		return nil, err
+	}
+	if available(cp, loan.Lender, now) < loan.Quantity {
+		fmt.Println("The company " + loan.Lender + " doesn't have enough of " + loan.CUSIP + " to lend")
+		return nil, errors.New("The company " + loan.Lender + " doesn't have enough of " + loan.CUSIP + " to lend")
+	}
+	// The paper may have moved in price since the loan was offered
+	err = checkCollateral(cp, loan, now)
+	if err != nil {
+		return nil, err
+	}
+	lender, err := GetCompany(loan.Lender, stub)
+	if err != nil {
+		return nil, err
+	}
+	borrower, err := GetCompany(loan.Borrower, stub)
+	if err != nil {
+		return nil, err
+	}
+	if availableCash(borrower, loan.Currency, now) < loan.Collateral {
+		fmt.Println("The company " + loan.Borrower + " doesn't have enough cash to post as collateral")
+		return nil, errors.New("The company " + loan.Borrower + " doesn't have enough " + loan.Currency + " cash to post " + loan.Collateral.String() + " of collateral")
+	}
+
+	// The paper goes to the borrower, free to sell, and the collateral to
+	// the lender
+	moveQuantity(&cp, loan.Lender, loan.Borrower, loan.Quantity)
+	addCash(&borrower, loan.Currency, -loan.Collateral)
+	addCash(&lender, loan.Currency, loan.Collateral)
+	borrower.AssetsIds = append(borrower.AssetsIds, loan.CUSIP)
+
+	loan.Status = loanOpen
+	loan.Start = timeToMs(now)
+
+	// Write everything back
+	err = putCompany(stub, borrower)
+	if err != nil {
+		return nil, err
+	}
+	err = putCompany(stub, lender)
+	if err != nil {
+		return nil, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+	err = putLoan(stub, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Opened loan " + loan.ID)
+	return json.Marshal(&loan)
+}
+
+func (t *SimpleChaincode) rejectLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Rejecting loan")
+	/*		0
+		loan ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting loan ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	loan, err := answerLoan(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	loan.Status = proposalRejected
+	err = putLoan(stub, loan)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rejected loan " + loan.ID)
+	return nil, nil
+}
+
+// openLoan loads an open loan for the party ending it, which is the company
+// named in the caller's certificate
+func openLoan(stub shim.ChaincodeStubInterface, loanID string, lender bool) (Loan, error) {
+	company, err := callerCompany(stub)
+	if err != nil {
+		return Loan{}, err
+	}
+	loan, err := GetLoan(loanID, stub)
+	if err != nil {
+		return loan, err
+	}
+	party := loan.Borrower
+	if lender {
+		party = loan.Lender
+	}
+	if company != party {
+		fmt.Println("Loan " + loanID + " can't be ended by " + company)
+		return loan, errors.New("Loan " + loanID + " can only be ended here by " + party)
+	}
+	if loan.Status != loanOpen {
+		fmt.Println("Loan " + loanID + " is " + loan.Status)
+		return loan, errors.New("Loan " + loanID + " is " + loan.Status)
+	}
+
+	return loan, nil
+}
+
+func (t *SimpleChaincode) returnLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Returning loan")
+	/*		0
+		loan ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting loan ID")
+	}
+
+	// Only the borrower can hand the paper back
+	loan, err := openLoan(stub, args[0], false)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	err = endLoan(stub, &loan, loanReturned, true, 0, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&loan)
+}
+
+func (t *SimpleChaincode) recallLoan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Recalling loan")
+	/*		0
+		loan ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting loan ID")
+	}
+
+	// Only the lender can recall the paper
+	loan, err := openLoan(stub, args[0], true)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	// A borrower that no longer holds the paper is bought in, the lender
+	// keeps what the paper is worth out of the collateral
+	cp, err := GetCP(cpPrefix + loan.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+	if available(cp, loan.Borrower, now) >= loan.Quantity {
+		err = endLoan(stub, &loan, loanRecalled, true, 0, now)
+	} else {
+		var buyIn Money
+		buyIn, err = buyInValue(cp, loan.Quantity, now)
+		if err != nil {
+			return nil, err
+		}
+		err = endLoan(stub, &loan, loanRecalled, false, buyIn, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&loan)
+}
+
+// GetLoans returns the company's outstanding loans as lender and borrower,
+// with the fee accrued to date when the query has a timestamp
+func GetLoans(companyID string, stub shim.ChaincodeStubInterface) (LoanBook, error) {
+	book := LoanBook{Company: companyID, Lent: []Loan{}, Borrowed: []Loan{}}
+
+	loans, err := getLoans(stub)
+	if err != nil {
+		return book, err
+	}
+	now, timeErr := txTime(stub)
+	for _, loan := range loans {
+		if loan.Status != loanOpen {
+			continue
+		}
+		if timeErr == nil {
+			loan.Accrued, err = loanFee(loan, now)
+			if err != nil {
+				return book, err
+			}
+		}
+		if loan.Lender == companyID {
+			book.Lent = append(book.Lent, loan)
+		}
+		if loan.Borrower == companyID {
+			book.Borrowed = append(book.Borrowed, loan)
+		}
+	}
+
+	return book, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLoanParties(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	offer := func(collateral float64) string {
+		return toJSON(t, map[string]interface{}{
+			"cusip":      cusip,
+			"borrower":   "company2",
+			"quantity":   5,
+			"collateral": collateral,
+			"feeRate":    0.5,
+		})
+	}
+
+	// The lender is whoever offers, so a company without the paper can't
+	// lend it, and the collateral has to cover the paper
+	_, err := invoke(stub, cc, "company3", "offerLoan", offer(5100.00))
+	if err == nil {
+		t.Error("company3 lent paper it doesn't hold")
+	}
+	_, err = invoke(stub, cc, "company1", "offerLoan", offer(5000.00))
+	if err == nil {
+		t.Error("a loan was offered with too little collateral")
+	}
+	var loan Loan
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company1", "offerLoan", offer(5100.00)), &loan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loan.Lender != "company1" {
+		t.Fatalf("loan lent by %q, want company1", loan.Lender)
+	}
+
+	// Only the borrower can accept
+	for _, caller := range []string{"company1", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "acceptLoan", loan.ID)
+		if err == nil {
+			t.Errorf("%q accepted a loan to company2", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptLoan", loan.ID)
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 5, "company2": 5})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 510000,
+		"company2": initialCashBalance - 510000,
+	})
+
+	// Only the lender can recall and only the borrower can return
+	stub.now = stub.now.Add(10 * 24 * time.Hour)
+	for _, test := range []struct {
+		function string
+		caller   string
+	}{
+		{"recallLoan", "company2"},
+		{"recallLoan", "company3"},
+		{"returnLoan", "company1"},
+		{"returnLoan", "company3"},
+	} {
+		_, err := invoke(stub, cc, test.caller, test.function, loan.ID)
+		if err == nil {
+			t.Errorf("%q could %s", test.caller, test.function)
+		}
+	}
+	mustInvoke(t, stub, cc, "company2", "returnLoan", loan.ID)
+
+	// Ten days of fee at 0.5% on the collateral is kept by the lender
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 10, "company2": 0})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 71,
+		"company2": initialCashBalance - 71,
+	})
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Money is an amount of cash held as a whole number of cents, so balances
+// add up exactly. In JSON it is a decimal number of dollars, the same format
+// the float balances it replaced were written in.
+type Money int64
+
+// Rate is a percentage held as a whole number of millionths of a percent.
+// In JSON it is a decimal number of percent.
+type Rate int64
+
+const (
+	moneyScale = 100
+	rateScale  = 1000000
+)
+
+var moneyMigratedKey = "MoneyMigrated"
+
+// roundRat rounds to the nearest whole number with halves going to the even
+// neighbour. Every cash amount worked out from a rate is rounded this way to
+// the cent, once, on the final amount.
+func roundRat(r *big.Rat) int64 {
+	quo, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+
+	twice := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2))
+	cmp := twice.Cmp(r.Denom())
+	if cmp > 0 || (cmp == 0 && quo.Bit(0) == 1) {
+		if r.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+
+	return quo.Int64()
+}
+
+// parseDecimal reads a decimal number, quoted or not, into whole units of
+// 1/scale, rounding any further decimal places
+func parseDecimal(data []byte, scale int64) (int64, error) {
+	text := strings.Trim(string(data), `"`)
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return 0, errors.New("Invalid decimal amount " + text)
+	}
+
+	return roundRat(r.Mul(r, big.NewRat(scale, 1))), nil
+}
+
+// formatDecimal writes whole units of 1/scale as a decimal number with the
+// given number of places
+func formatDecimal(units int64, scale int64, places int) string {
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+
+	text := sign + strconv.FormatInt(units / scale, 10)
+	if places > 0 {
+		text += fmt.Sprintf(".%0*d", places, units % scale)
+	}
+	return text
+}
+
+// moneyFromRat rounds an amount in cents to a whole number of cents
+func moneyFromRat(cents *big.Rat) Money {
+	return Money(roundRat(cents))
+}
+
+func (m Money) String() string {
+	return formatDecimal(int64(m), moneyScale, 2)
+}
+
+// Float returns the amount in dollars, for reporting only
+func (m Money) Float() float64 {
+	return float64(m) / moneyScale
+}
+
+func (m Money) rat() *big.Rat {
+	return big.NewRat(int64(m), 1)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	units, err := parseDecimal(data, moneyScale)
+	if err != nil {
+		return err
+	}
+	*m = Money(units)
+	return nil
+}
+
+func (r Rate) String() string {
+	text := formatDecimal(int64(r), rateScale, 6)
+	text = strings.TrimRight(text, "0")
+	return strings.TrimSuffix(text, ".")
+}
+
+// Float returns the rate in percent, for reporting only
+func (r Rate) Float() float64 {
+	return float64(r) / rateScale
+}
+
+// fraction returns the rate as a fraction of one, so 7.5% is 3/40
+func (r Rate) fraction() *big.Rat {
+	return big.NewRat(int64(r), 100 * rateScale)
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	units, err := parseDecimal(data, rateScale)
+	if err != nil {
+		return err
+	}
+	*r = Rate(units)
+	return nil
+}
+
+func (t *SimpleChaincode) migrateMoney(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Migrating money amounts")
+
+	// Records written with float amounts are rounded to the cent when read,
+	// rewriting them stores the exact amounts. It only needs doing once.
+	doneBytes, err := stub.GetState(moneyMigratedKey)
+	if err != nil {
+		fmt.Println("Error retrieving migration flag")
+		return nil, errors.New("Error retrieving migration flag")
+	}
+	if doneBytes != nil {
+		fmt.Println("Money amounts already migrated")
+		return nil, errors.New("Money amounts have already been migrated")
+	}
+
+	// Accounts aren't indexed, so walk the whole account key range
+	iter, err := stub.RangeQueryState(accountPrefix, accountPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading accounts")
+		return nil, errors.New("Error reading accounts: " + err.Error())
+	}
+	var accounts []Account
+	for iter.HasNext() {
+		key, accountBytes, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, errors.New("Error reading accounts: " + err.Error())
+		}
+		var account Account
+		err = json.Unmarshal(accountBytes, &account)
+		if err != nil {
+			iter.Close()
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		accounts = append(accounts, account)
+	}
+	iter.Close()
+
+	for _, account := range accounts {
+		err = putCompany(stub, account)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	allCPs, err := GetAllCPs(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range allCPs {
+		err = putCP(stub, cp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	programs, err := GetPrograms("", stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, program := range programs {
+		err = putProgram(stub, program.Program)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = stub.PutState(moneyMigratedKey, []byte("true"))
+	if err != nil {
+		fmt.Println("Error writing migration flag")
+		return nil, errors.New("Error writing migration flag")
+	}
+
+	fmt.Printf("Migrated %d accounts, %d papers and %d programs\n", len(accounts), len(allCPs), len(programs))
+	return nil, nil
+}
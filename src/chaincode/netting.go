@@ -0,0 +1,487 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var nettingWindowKey = "NettingWindow"
+var nettingPrefix = "netting:"
+
+// NettingWindow collects the transfers agreed for net settlement. Each one
+// waits as an obligation, priced when it was agreed, until the window is
+// settled and its obligations become trades under the same IDs. Obligations
+// a counterparty cancelled, or whose paper can no longer trade, are kept
+// apart so they don't hold up the rest.
+type NettingWindow struct {
+	ID          string  `json:"id"`
+	Opened      string  `json:"opened"`
+	Obligations []Trade `json:"obligations"`
+	Cancelled   []Trade `json:"cancelled,omitempty"`
+	Lapsed      []Trade `json:"lapsed,omitempty"`
+	Settled     string  `json:"settled,omitempty"`
+}
+
+// NetCash is what a participant pays, when negative, or receives in one
+// currency once the window is netted, transfer fees included
+type NetCash struct {
+	Company   string `json:"company"`
+	Currency  string `json:"currency"`
+	Net       Money  `json:"net"`
+	Available Money  `json:"available"`
+	Shortfall Money  `json:"shortfall,omitempty"`
+}
+
+// NetPosition is what a participant delivers, when negative, or receives of
+// one paper once the window is netted
+type NetPosition struct {
+	Company   string `json:"company"`
+	CUSIP     string `json:"cusip"`
+	Net       int    `json:"net"`
+	Available int    `json:"available"`
+	Shortfall int    `json:"shortfall,omitempty"`
+}
+
+// NettingResult is the net settlement of a window against the state as it
+// stands. It only settles if no participant falls short. Lapsed obligations
+// are left out of the nets and close with the window unsettled.
+type NettingResult struct {
+	Window      string        `json:"window"`
+	Obligations []Trade       `json:"obligations"`
+	Lapsed      []Trade       `json:"lapsed"`
+	Cash        []NetCash     `json:"cash"`
+	Positions   []NetPosition `json:"positions"`
+	Settleable  bool          `json:"settleable"`
+}
+
+// GetNettingWindow returns the open netting window, which has no ID until
+// an obligation opens it
+func GetNettingWindow(stub shim.ChaincodeStubInterface) (NettingWindow, error) {
+	window := NettingWindow{Obligations: []Trade{}}
+
+	windowBytes, err := stub.GetState(nettingWindowKey)
+	if err != nil {
+		fmt.Println("Error retrieving netting window")
+		return window, errors.New("Error retrieving netting window")
+	}
+	if windowBytes == nil {
+		return window, nil
+	}
+
+	err = json.Unmarshal(windowBytes, &window)
+	if err != nil {
+		fmt.Println("Error unmarshalling netting window")
+		return window, errors.New("Error unmarshalling netting window")
+	}
+
+	return window, nil
+}
+
+func putNettingWindow(stub shim.ChaincodeStubInterface, key string, window NettingWindow) error {
+	windowBytes, err := json.Marshal(&window)
+	if err != nil {
+		fmt.Println("Error marshalling netting window " + window.ID)
+		return errors.New("Error marshalling netting window " + window.ID)
+	}
+	err = stub.PutState(key, windowBytes)
+	if err != nil {
+		fmt.Println("Error writing netting window " + window.ID)
+		return errors.New("Error writing netting window " + window.ID)
+	}
+
+	return nil
+}
+
+// queueObligation prices an agreed transfer and adds it to the open netting
+// window under the given ID, opening the window if need be
+func queueObligation(stub shim.ChaincodeStubInterface, tr Transaction, obligationID string, now time.Time) (Trade, error) {
+	var obligation Trade
+
+	cp, err := GetCP(cpPrefix + tr.CUSIP, stub)
+	if err != nil {
+		return obligation, err
+	}
+	currency, err := transferTerms(cp, tr)
+	if err != nil {
+		return obligation, err
+	}
+	discount, amount, err := transferPrice(cp, tr, now)
+	if err != nil {
+		return obligation, err
+	}
+	_, err = GetCompany(tr.FromCompany, stub)
+	if err != nil {
+		return obligation, err
+	}
+	_, err = GetCompany(tr.ToCompany, stub)
+	if err != nil {
+		return obligation, err
+	}
+
+	window, err := GetNettingWindow(stub)
+	if err != nil {
+		return obligation, err
+	}
+	if window.ID == "" {
+		window.ID = obligationID
+		window.Opened = timeToMs(now)
+	}
+	obligation = Trade{
+		ID:          obligationID,
+		CUSIP:       tr.CUSIP,
+		FromCompany: tr.FromCompany,
+		ToCompany:   tr.ToCompany,
+		Quantity:    tr.Quantity,
+		Discount:    discount,
+		Amount:      amount,
+		Currency:    currency,
+		Timestamp:   timeToMs(now),
+	}
+	window.Obligations = append(window.Obligations, obligation)
+	err = putNettingWindow(stub, nettingWindowKey, window)
+	if err != nil {
+		return obligation, err
+	}
+
+	fmt.Println("Queued obligation " + obligation.ID + " in netting window " + window.ID)
+	return obligation, nil
+}
+
+// netCash returns the entry for the company and currency, adding it if the
+// company has none yet so entries keep the order they first appear in
+func netCash(entries *[]NetCash, company string, currency string) *NetCash {
+	for i := range *entries {
+		if (*entries)[i].Company == company && (*entries)[i].Currency == currency {
+			return &(*entries)[i]
+		}
+	}
+	*entries = append(*entries, NetCash{Company: company, Currency: currency})
+	return &(*entries)[len(*entries) - 1]
+}
+
+// netPosition returns the entry for the company and paper, adding it if the
+// company has none yet
+func netPosition(entries *[]NetPosition, company string, cusip string) *NetPosition {
+	for i := range *entries {
+		if (*entries)[i].Company == company && (*entries)[i].CUSIP == cusip {
+			return &(*entries)[i]
+		}
+	}
+	*entries = append(*entries, NetPosition{Company: company, CUSIP: cusip})
+	return &(*entries)[len(*entries) - 1]
+}
+
+// projectNetting nets the window's obligations per participant and checks
+// each net debit and net delivery against what the participant has free.
+// An obligation whose paper has matured or can't trade any more lapses
+// rather than blocking the window. The ledger loads the papers and accounts
+// involved. Nothing is changed.
+func projectNetting(ledger *batchLedger, window NettingWindow, schedule FeeSchedule, now time.Time) (NettingResult, error) {
+	result := NettingResult{
+		Window:      window.ID,
+		Obligations: []Trade{},
+		Lapsed:      []Trade{},
+		Cash:        []NetCash{},
+		Positions:   []NetPosition{},
+		Settleable:  true,
+	}
+
+	for _, obligation := range window.Obligations {
+		cp, err := ledger.paper(obligation.CUSIP)
+		if err != nil {
+			return result, err
+		}
+		// The paper has to still be tradeable when the window settles
+		_, err = transferTerms(*cp, Transaction{CUSIP: obligation.CUSIP, Quantity: obligation.Quantity})
+		if err == nil && cp.Status != paperDefaulted {
+			_, err = daysToMaturity(*cp, now)
+		}
+		if err != nil {
+			fmt.Println("Obligation " + obligation.ID + " lapses: " + err.Error())
+			result.Lapsed = append(result.Lapsed, obligation)
+			continue
+		}
+		result.Obligations = append(result.Obligations, obligation)
+
+		fee := schedule.Transfer.amount(obligation.Amount)
+		netCash(&result.Cash, obligation.ToCompany, obligation.Currency).Net -= obligation.Amount
+		netCash(&result.Cash, obligation.FromCompany, obligation.Currency).Net += obligation.Amount - fee
+		if fee != 0 {
+			netCash(&result.Cash, schedule.Operator, obligation.Currency).Net += fee
+		}
+		netPosition(&result.Positions, obligation.FromCompany, obligation.CUSIP).Net -= obligation.Quantity
+		netPosition(&result.Positions, obligation.ToCompany, obligation.CUSIP).Net += obligation.Quantity
+	}
+
+	for i := range result.Cash {
+		entry := &result.Cash[i]
+		account, err := ledger.account(entry.Company)
+		if err != nil {
+			return result, err
+		}
+		entry.Available = availableCash(*account, entry.Currency, now)
+		if entry.Net < 0 && entry.Available < -entry.Net {
+			entry.Shortfall = -entry.Net - entry.Available
+			result.Settleable = false
+		}
+	}
+	for i := range result.Positions {
+		entry := &result.Positions[i]
+		cp, err := ledger.paper(entry.CUSIP)
+		if err != nil {
+			return result, err
+		}
+		entry.Available = available(*cp, entry.Company, now)
+		if entry.Net < 0 && entry.Available < -entry.Net {
+			entry.Shortfall = -entry.Net - entry.Available
+			result.Settleable = false
+		}
+	}
+
+	return result, nil
+}
+
+// applyNetting moves each participant's net cash and net position through
+// the ledger and records a trade and a transfer fee for every obligation
+// that settles
+func applyNetting(ledger *batchLedger, result NettingResult, schedule FeeSchedule) error {
+	for _, entry := range result.Cash {
+		account, err := ledger.account(entry.Company)
+		if err != nil {
+			return err
+		}
+		addCash(account, entry.Currency, entry.Net)
+	}
+	for _, entry := range result.Positions {
+		cp, err := ledger.paper(entry.CUSIP)
+		if err != nil {
+			return err
+		}
+		found := false
+		for key, owner := range cp.Owners {
+			if owner.Company == entry.Company {
+				found = true
+				cp.Owners[key].Quantity += entry.Net
+			}
+		}
+		if !found {
+			cp.Owners = append(cp.Owners, Owner{Company: entry.Company, Quantity: entry.Net})
+		}
+	}
+
+	for _, obligation := range result.Obligations {
+		trade := obligation
+		trade.Fee = schedule.Transfer.amount(trade.Amount)
+		fromCompany, err := ledger.account(trade.FromCompany)
+		if err != nil {
+			return err
+		}
+		toCompany, err := ledger.account(trade.ToCompany)
+		if err != nil {
+			return err
+		}
+		fromCompany.TradeIds = append(fromCompany.TradeIds, trade.ID)
+		toCompany.TradeIds = append(toCompany.TradeIds, trade.ID)
+		ledger.trades = append(ledger.trades, trade)
+		if trade.Fee != 0 {
+			ledger.fees = append(ledger.fees, FeeRecord{
+				ID:        trade.ID,
+				Kind:      transferFee,
+				Payer:     trade.FromCompany,
+				CUSIP:     trade.CUSIP,
+				Currency:  trade.Currency,
+				Basis:     trade.Amount,
+				Amount:    trade.Fee,
+				Operator:  schedule.Operator,
+				Timestamp: trade.Timestamp,
+			})
+		}
+	}
+
+	return nil
+}
+
+// nettingShortfall describes the first participant that falls short
+func nettingShortfall(result NettingResult) error {
+	for _, entry := range result.Cash {
+		if entry.Shortfall > 0 {
+			fmt.Println("The company " + entry.Company + " can't cover its net debit")
+			return errors.New("The company " + entry.Company + " has a net debit of " + (-entry.Net).String() + " " + entry.Currency + " but only " + entry.Available.String() + " cash available")
+		}
+	}
+	for _, entry := range result.Positions {
+		if entry.Shortfall > 0 {
+			fmt.Println("The company " + entry.Company + " can't deliver its net position")
+			return errors.New("The company " + entry.Company + " has to deliver a net " + strconv.Itoa(-entry.Net) + " of " + entry.CUSIP + " but only has " + strconv.Itoa(entry.Available) + " free")
+		}
+	}
+	return nil
+}
+
+func (t *SimpleChaincode) netSettle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Net settling")
+	//need no args
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting none")
+	}
+
+	window, err := GetNettingWindow(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(window.Obligations) == 0 {
+		return nil, errors.New("No obligations are waiting for net settlement")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	schedule, err := GetFeeSchedule(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Either every participant settles or the window stays as it is
+	ledger := newBatchLedger(stub)
+	result, err := projectNetting(ledger, window, schedule, now)
+	if err != nil {
+		return nil, err
+	}
+	err = nettingShortfall(result)
+	if err != nil {
+		return nil, err
+	}
+	err = applyNetting(ledger, result, schedule)
+	if err != nil {
+		return nil, err
+	}
+	err = ledger.write()
+	if err != nil {
+		return nil, err
+	}
+
+	// Whatever lapsed closes with the window, so the next one starts clean
+	window.Obligations = result.Obligations
+	window.Lapsed = append(window.Lapsed, result.Lapsed...)
+	window.Settled = timeToMs(now)
+	err = putNettingWindow(stub, nettingPrefix + window.ID, window)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(nettingWindowKey)
+	if err != nil {
+		fmt.Println("Error closing netting window " + window.ID)
+		return nil, errors.New("Error closing netting window " + window.ID)
+	}
+
+	fmt.Printf("Net settled window %s of %d obligations, %d lapsed\n", window.ID, len(result.Obligations), len(result.Lapsed))
+	return json.Marshal(&result)
+}
+
+// cancelObligation takes an obligation out of the open window. Either
+// counterparty may cancel it, as the caller's certificate shows. The
+// obligation is kept on the window as cancelled and the window closes
+// without settling once nothing is left in it.
+func (t *SimpleChaincode) cancelObligation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Cancelling obligation")
+	//need one arg, the obligation ID
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting obligation ID")
+	}
+
+	company, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	window, err := GetNettingWindow(stub)
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	for i, obligation := range window.Obligations {
+		if obligation.ID == args[0] {
+			index = i
+		}
+	}
+	if index < 0 {
+		fmt.Println("Obligation " + args[0] + " isn't in the netting window")
+		return nil, errors.New("Obligation " + args[0] + " isn't in the netting window")
+	}
+	obligation := window.Obligations[index]
+	if company != obligation.FromCompany && company != obligation.ToCompany {
+		fmt.Println("The company " + company + " isn't party to obligation " + obligation.ID)
+		return nil, errors.New("The company " + company + " isn't party to obligation " + obligation.ID)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	window.Obligations = append(window.Obligations[:index], window.Obligations[index + 1:]...)
+	window.Cancelled = append(window.Cancelled, obligation)
+	if len(window.Obligations) > 0 {
+		err = putNettingWindow(stub, nettingWindowKey, window)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		window.Settled = timeToMs(now)
+		err = putNettingWindow(stub, nettingPrefix + window.ID, window)
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(nettingWindowKey)
+		if err != nil {
+			fmt.Println("Error closing netting window " + window.ID)
+			return nil, errors.New("Error closing netting window " + window.ID)
+		}
+	}
+
+	fmt.Println("Company " + company + " cancelled obligation " + obligation.ID)
+	return json.Marshal(&obligation)
+}
+
+// GetNetting projects the net settlement of the open window against the
+// state as it stands
+func GetNetting(stub shim.ChaincodeStubInterface) (NettingResult, error) {
+	window, err := GetNettingWindow(stub)
+	if err != nil {
+		return NettingResult{}, err
+	}
+	schedule, err := GetFeeSchedule(stub)
+	if err != nil {
+		return NettingResult{}, err
+	}
+	// Without a timestamp every hold counts as active
+	now, err := txTime(stub)
+	if err != nil {
+		now = time.Time{}
+	}
+
+	return projectNetting(newBatchLedger(stub), window, schedule, now)
+}
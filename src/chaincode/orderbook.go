@@ -0,0 +1,392 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var bookPrefix = "book:"
+
+// Order sides
+const (
+	bidOrder = "bid"
+	askOrder = "ask"
+)
+
+// Order is a bid to buy or an ask to sell paper at a discount rate. A bid
+// accepts any discount at or above its own, an ask any discount at or below.
+type Order struct {
+	ID        string `json:"id"`
+	CUSIP     string `json:"cusip"`
+	Company   string `json:"company"`
+	Side      string `json:"side"`
+	Quantity  int    `json:"quantity"`
+	Remaining int    `json:"remaining"`
+	Discount  Rate   `json:"discount"`
+	Seq       int    `json:"seq"`
+	Timestamp string `json:"timestamp"`
+}
+
+// OrderBook holds the resting orders for a CUSIP, each side in priority
+// order. Seq numbers orders as they arrive so time priority doesn't depend
+// on timestamps.
+type OrderBook struct {
+	CUSIP string  `json:"cusip"`
+	Seq   int     `json:"seq"`
+	Bids  []Order `json:"bids"`
+	Asks  []Order `json:"asks"`
+}
+
+// OrderResult is an order as it stands after matching and the trades it
+// filled
+type OrderResult struct {
+	Order  Order   `json:"order"`
+	Trades []Trade `json:"trades"`
+}
+
+// GetOrderBook returns the order book for the CUSIP, which is empty if no
+// order has been placed
+func GetOrderBook(cusip string, stub shim.ChaincodeStubInterface) (OrderBook, error) {
+	book := OrderBook{CUSIP: cusip, Bids: []Order{}, Asks: []Order{}}
+
+	bookBytes, err := stub.GetState(bookPrefix + cusip)
+	if err != nil {
+		fmt.Println("Error retrieving order book " + cusip)
+		return book, errors.New("Error retrieving order book " + cusip)
+	}
+	if bookBytes == nil {
+		return book, nil
+	}
+
+	err = json.Unmarshal(bookBytes, &book)
+	if err != nil {
+		fmt.Println("Error unmarshalling order book " + cusip)
+		return book, errors.New("Error unmarshalling order book " + cusip)
+	}
+
+	return book, nil
+}
+
+func putOrderBook(stub shim.ChaincodeStubInterface, book OrderBook) error {
+	bookBytes, err := json.Marshal(&book)
+	if err != nil {
+		fmt.Println("Error marshalling order book " + book.CUSIP)
+		return errors.New("Error marshalling order book " + book.CUSIP)
+	}
+	err = stub.PutState(bookPrefix + book.CUSIP, bookBytes)
+	if err != nil {
+		fmt.Println("Error writing order book " + book.CUSIP + " back")
+		return errors.New("Error writing order book " + book.CUSIP + " back")
+	}
+
+	return nil
+}
+
+// ahead reports whether order a has priority over order b on the same side.
+// A lower discount is a better bid and a higher discount a better ask, with
+// earlier orders first at the same discount.
+func ahead(a, b Order) bool {
+	if a.Discount != b.Discount {
+		if a.Side == bidOrder {
+			return a.Discount < b.Discount
+		}
+		return a.Discount > b.Discount
+	}
+	return a.Seq < b.Seq
+}
+
+// insertOrder adds the order to its side of the book in priority order
+func insertOrder(orders []Order, order Order) []Order {
+	i := 0
+	for i < len(orders) && ahead(orders[i], order) {
+		i++
+	}
+	orders = append(orders, Order{})
+	copy(orders[i + 1:], orders[i:])
+	orders[i] = order
+	return orders
+}
+
+// crosses reports whether a bid and an ask can trade
+func crosses(bid, ask Order) bool {
+	return bid.Discount <= ask.Discount
+}
+
+// canFill checks that the company behind a resting order can still settle
+// quantity units at the order's discount
+func canFill(stub shim.ChaincodeStubInterface, order Order, quantity int, now time.Time) (bool, error) {
+	cp, err := GetCP(cpPrefix + order.CUSIP, stub)
+	if err != nil {
+		return false, err
+	}
+	if order.Side == askOrder {
+		return available(cp, order.Company, now) >= quantity, nil
+	}
+
+	company, err := GetCompany(order.Company, stub)
+	if err != nil {
+		return false, err
+	}
+	amount, err := paperPrice(cp, quantity, order.Discount, now)
+	if err != nil {
+		return false, err
+	}
+	return availableCash(company, paperCurrency(cp), now) >= amount, nil
+}
+
+func (t *SimpleChaincode) placeOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Placing order")
+	/*		0
+		json
+	  	{
+			"cusip": "",
+			"side": "bid",  (or "ask")
+			"quantity": 5,
+			"discount": 7.5
+		}
+	*/
+	// The order is placed for the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting order")
+	}
+
+	var order Order
+	err := json.Unmarshal([]byte(args[0]), &order)
+	if err != nil {
+		fmt.Println("Error unmarshalling order")
+		return nil, errors.New("Invalid order")
+	}
+	order.Company, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if order.Side != bidOrder && order.Side != askOrder {
+		return nil, errors.New("Order side must be " + bidOrder + " or " + askOrder)
+	}
+	if order.Quantity <= 0 {
+		return nil, errors.New("Order quantity must be positive")
+	}
+	if order.Discount < 0 || order.Discount >= 100 * rateScale {
+		return nil, errors.New("Order discount must be at least 0 and below 100")
+	}
+
+	// Only paper that is still running trades on the book, distressed paper
+	// is traded bilaterally with transferPaper
+	cp, err := GetCP(cpPrefix + order.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Status == paperMatured || cp.Status == paperDefaulted {
+		fmt.Println("The paper " + order.CUSIP + " is " + cp.Status)
+		return nil, errors.New("The paper " + order.CUSIP + " is " + cp.Status + " and can't be traded on the book")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	_, err = daysToMaturity(cp, now)
+	if err != nil {
+		return nil, err
+	}
+
+	company, err := GetCompany(order.Company, stub)
+	if err != nil {
+		return nil, err
+	}
+	book, err := GetOrderBook(order.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Asks can't offer more than the company holds across all its asks, bids
+	// must be covered by cash at the bid's own discount
+	if order.Side == askOrder {
+		offered := order.Quantity
+		for _, ask := range book.Asks {
+			if ask.Company == order.Company {
+				offered += ask.Remaining
+			}
+		}
+		if offered > available(cp, order.Company, now) {
+			fmt.Println("The company " + order.Company + " doesn't hold enough of " + order.CUSIP)
+			return nil, errors.New("The company " + order.Company + " doesn't hold enough of " + order.CUSIP + " to cover its asks")
+		}
+	} else {
+		amount, err := paperPrice(cp, order.Quantity, order.Discount, now)
+		if err != nil {
+			return nil, err
+		}
+		if availableCash(company, paperCurrency(cp), now) < amount {
+			fmt.Println("The company " + order.Company + " doesn't have enough cash for its bid")
+			return nil, errors.New("The company " + order.Company + " doesn't have enough " + paperCurrency(cp) + " cash to cover its bid")
+		}
+	}
+
+	book.Seq++
+	order.ID = stub.GetTxID()
+	order.Remaining = order.Quantity
+	order.Seq = book.Seq
+	order.Timestamp = timeToMs(now)
+
+	// Match against the other side in priority order, each fill at the
+	// resting order's discount. Resting orders that can no longer settle are
+	// dropped and a company's own orders are skipped.
+	opposite := book.Bids
+	if order.Side == bidOrder {
+		opposite = book.Asks
+	}
+	trades := []Trade{}
+	var resting []Order
+	for _, other := range opposite {
+		bid, ask := order, other
+		if order.Side == askOrder {
+			bid, ask = other, order
+		}
+		if order.Remaining == 0 || other.Company == order.Company || !crosses(bid, ask) {
+			resting = append(resting, other)
+			continue
+		}
+
+		quantity := order.Remaining
+		if other.Remaining < quantity {
+			quantity = other.Remaining
+		}
+		ok, err := canFill(stub, other, quantity, now)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			fmt.Println("Dropping order " + other.ID + " that can no longer settle")
+			continue
+		}
+
+		discount := other.Discount
+		trade, err := settleTransfer(stub, Transaction{
+			CUSIP:       order.CUSIP,
+			FromCompany: ask.Company,
+			ToCompany:   bid.Company,
+			Quantity:    quantity,
+			Discount:    &discount,
+		}, order.ID + "-" + strconv.Itoa(len(trades) + 1), now)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+
+		order.Remaining -= quantity
+		other.Remaining -= quantity
+		if other.Remaining > 0 {
+			resting = append(resting, other)
+		}
+	}
+	if resting == nil {
+		resting = []Order{}
+	}
+
+	if order.Side == bidOrder {
+		book.Asks = resting
+		if order.Remaining > 0 {
+			book.Bids = insertOrder(book.Bids, order)
+		}
+	} else {
+		book.Bids = resting
+		if order.Remaining > 0 {
+			book.Asks = insertOrder(book.Asks, order)
+		}
+	}
+	err = putOrderBook(stub, book)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Placed order %s with %d fills\n", order.ID, len(trades))
+	return json.Marshal(&OrderResult{Order: order, Trades: trades})
+}
+
+func (t *SimpleChaincode) cancelOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Cancelling order")
+	/*		0
+		json
+	  	{
+			"cusip": "",
+			"id": "order ID"
+		}
+	*/
+	// Only the company that placed the order can cancel it
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting order to cancel")
+	}
+
+	var cancel struct {
+		CUSIP   string `json:"cusip"`
+		ID      string `json:"id"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &cancel)
+	if err != nil {
+		fmt.Println("Error unmarshalling order cancel")
+		return nil, errors.New("Invalid order cancel")
+	}
+	company, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	book, err := GetOrderBook(cancel.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, side := range []*[]Order{&book.Bids, &book.Asks} {
+		for i, order := range *side {
+			if order.ID != cancel.ID {
+				continue
+			}
+			if order.Company != company {
+				fmt.Println("Order " + cancel.ID + " doesn't belong to " + company)
+				return nil, errors.New("Order " + cancel.ID + " doesn't belong to " + company)
+			}
+			*side = append((*side)[:i], (*side)[i + 1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		fmt.Println("Order not found " + cancel.ID)
+		return nil, errors.New("Order not found " + cancel.ID)
+	}
+
+	err = putOrderBook(stub, book)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Cancelled order " + cancel.ID)
+	return nil, nil
+}
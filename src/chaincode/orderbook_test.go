@@ -0,0 +1,88 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOrdersMatchForTheCaller(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	order := func(side string, quantity int, discount float64) string {
+		return toJSON(t, map[string]interface{}{
+			"cusip":    cusip,
+			"side":     side,
+			"quantity": quantity,
+			"discount": discount,
+		})
+	}
+
+	// Asks are placed for the caller, who has to hold the paper
+	_, err := invoke(stub, cc, "company3", "placeOrder", order(askOrder, 4, 3.6))
+	if err == nil {
+		t.Error("company3 offered paper it doesn't hold")
+	}
+	var ask OrderResult
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company1", "placeOrder", order(askOrder, 4, 3.6)), &ask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ask.Order.Company != "company1" {
+		t.Fatalf("ask placed for %q, want company1", ask.Order.Company)
+	}
+
+	// The bid fills at the resting ask's discount
+	var bid OrderResult
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company2", "placeOrder", order(bidOrder, 3, 3.5)), &bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bid.Trades) != 1 || bid.Order.Remaining != 0 {
+		t.Fatalf("bid filled %d trades with %d left, want 1 and 0", len(bid.Trades), bid.Order.Remaining)
+	}
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 7, "company2": 3})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 299100,
+		"company2": initialCashBalance - 299100,
+	})
+
+	// Only the company that placed the rest of the ask can cancel it
+	cancel := toJSON(t, map[string]interface{}{"cusip": cusip, "id": ask.Order.ID})
+	for _, caller := range []string{"company2", ""} {
+		_, err := invoke(stub, cc, caller, "cancelOrder", cancel)
+		if err == nil {
+			t.Errorf("%q cancelled company1's ask", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company1", "cancelOrder", cancel)
+	var book OrderBook
+	result, err := query(stub, cc, "company1", "GetOrderBook", cusip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(result, &book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Asks) != 0 || len(book.Bids) != 0 {
+		t.Errorf("book has %d asks and %d bids left, want none", len(book.Asks), len(book.Bids))
+	}
+}
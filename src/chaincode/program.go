@@ -0,0 +1,283 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var programPrefix = "prog:"
+var programKeysKey = "ProgramKeys"
+
+// Program is an issuance program that caps the face value an issuer can
+// have outstanding and the maturities it can issue at
+type Program struct {
+	ID             string  `json:"id"`
+	Issuer         string  `json:"issuer"`
+	MaxOutstanding Money  `json:"maxOutstanding"`
+	// Currency is the currency of the limit and of paper issued under it
+	Currency       string `json:"currency,omitempty"`
+	MinMaturity    int     `json:"minMaturity"`
+	MaxMaturity    int     `json:"maxMaturity"`
+	Outstanding    Money  `json:"outstanding"`
+}
+
+// ProgramUtilization reports how much of a program is in use
+type ProgramUtilization struct {
+	Program
+	Available   Money   `json:"available"`
+	Utilization float64 `json:"utilization"`
+}
+
+func (t *SimpleChaincode) createProgram(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Creating issuance program")
+	/*		0
+		json
+	  	{
+			"id": "string",
+			"issuer": "company2",
+			"maxOutstanding": 50000000.00,
+			"currency": "USD", (not required)
+			"minMaturity": 1,
+			"maxMaturity": 270
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting program record")
+	}
+
+	var program Program
+	err := json.Unmarshal([]byte(args[0]), &program)
+	if err != nil {
+		fmt.Println("Error unmarshalling program")
+		return nil, errors.New("Invalid issuance program")
+	}
+
+	if program.ID == "" {
+		return nil, errors.New("Program ID is required")
+	}
+	if program.Currency == "" {
+		program.Currency = defaultCurrency
+	}
+	if !validCurrency(program.Currency) {
+		return nil, errors.New("Invalid currency " + program.Currency)
+	}
+	if program.MaxOutstanding <= 0 {
+		return nil, errors.New("Program maximum outstanding must be positive")
+	}
+	if program.MinMaturity < minMaturityDays || program.MaxMaturity > maxMaturityDays || program.MinMaturity > program.MaxMaturity {
+		return nil, errors.New("Program maturity range must lie within " + strconv.Itoa(minMaturityDays) + " to " + strconv.Itoa(maxMaturityDays) + " days")
+	}
+	program.Outstanding = 0
+
+	existingBytes, err := stub.GetState(programPrefix + program.ID)
+	if err != nil {
+		fmt.Println("Error retrieving program " + program.ID)
+		return nil, errors.New("Error retrieving program " + program.ID)
+	}
+	if existingBytes != nil {
+		fmt.Println("Program already exists " + program.ID)
+		return nil, errors.New("Program already exists " + program.ID)
+	}
+
+	issuer, err := GetCompany(program.Issuer, stub)
+	if err != nil {
+		return nil, err
+	}
+	issuer.Programs = append(issuer.Programs, program.ID)
+
+	err = putProgram(stub, program)
+	if err != nil {
+		return nil, err
+	}
+	err = putCompany(stub, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the program keys by adding the new key
+	keys, err := getProgramKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, programPrefix + program.ID)
+	keysBytesToWrite, err := json.Marshal(&keys)
+	if err != nil {
+		fmt.Println("Error marshalling program keys")
+		return nil, errors.New("Error marshalling program keys")
+	}
+	err = stub.PutState(programKeysKey, keysBytesToWrite)
+	if err != nil {
+		fmt.Println("Error writing program keys back")
+		return nil, errors.New("Error writing program keys back")
+	}
+
+	fmt.Println("Created issuance program " + program.ID)
+	return nil, nil
+}
+
+func getProgramKeys(stub shim.ChaincodeStubInterface) ([]string, error) {
+	var keys []string
+
+	keysBytes, err := stub.GetState(programKeysKey)
+	if err != nil {
+		fmt.Println("Error retrieving program keys")
+		return nil, errors.New("Error retrieving program keys")
+	}
+	if keysBytes == nil {
+		return keys, nil
+	}
+
+	err = json.Unmarshal(keysBytes, &keys)
+	if err != nil {
+		fmt.Println("Error unmarshalling program keys")
+		return nil, errors.New("Error unmarshalling program keys")
+	}
+
+	return keys, nil
+}
+
+func GetProgram(programID string, stub shim.ChaincodeStubInterface) (Program, error) {
+	var program Program
+
+	programBytes, err := stub.GetState(programPrefix + programID)
+	if err != nil || programBytes == nil {
+		fmt.Println("Program not found " + programID)
+		return program, errors.New("Program not found " + programID)
+	}
+
+	err = json.Unmarshal(programBytes, &program)
+	if err != nil {
+		fmt.Println("Error unmarshalling program " + programID)
+		return program, errors.New("Error unmarshalling program " + programID)
+	}
+
+	return program, nil
+}
+
+func putProgram(stub shim.ChaincodeStubInterface, program Program) error {
+	programBytes, err := json.Marshal(&program)
+	if err != nil {
+		fmt.Println("Error marshalling program " + program.ID)
+		return errors.New("Error marshalling program " + program.ID)
+	}
+	err = stub.PutState(programPrefix + program.ID, programBytes)
+	if err != nil {
+		fmt.Println("Error writing program " + program.ID + " back")
+		return errors.New("Error writing program " + program.ID + " back")
+	}
+
+	return nil
+}
+
+// GetPrograms returns the utilization of every program, or only those of
+// the given issuer when one is passed
+func GetPrograms(issuer string, stub shim.ChaincodeStubInterface) ([]ProgramUtilization, error) {
+	var programs []ProgramUtilization
+
+	keys, err := getProgramKeys(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		program, err := GetProgram(key[len(programPrefix):], stub)
+		if err != nil {
+			return nil, err
+		}
+		if issuer != "" && program.Issuer != issuer {
+			continue
+		}
+
+		programs = append(programs, ProgramUtilization{
+			Program:     program,
+			Available:   program.MaxOutstanding - program.Outstanding,
+			Utilization: program.Outstanding.Float() / program.MaxOutstanding.Float() * 100.0,
+		})
+	}
+
+	return programs, nil
+}
+
+// drawProgram checks a new issue against the issuer's programs and adds its
+// face value to the program's outstanding total
+func drawProgram(stub shim.ChaincodeStubInterface, cp CP, issuer Account) error {
+	if cp.Program == "" {
+		if len(issuer.Programs) > 0 {
+			fmt.Println("No program given for " + cp.Issuer)
+			return errors.New("The issuer " + cp.Issuer + " must issue under one of its programs")
+		}
+		return nil
+	}
+
+	program, err := GetProgram(cp.Program, stub)
+	if err != nil {
+		return err
+	}
+	if program.Issuer != cp.Issuer {
+		fmt.Println("Program " + program.ID + " doesn't belong to " + cp.Issuer)
+		return errors.New("Program " + program.ID + " doesn't belong to " + cp.Issuer)
+	}
+	programCurrency := program.Currency
+	if programCurrency == "" {
+		programCurrency = defaultCurrency
+	}
+	if programCurrency != paperCurrency(cp) {
+		fmt.Println("Currency outside program " + program.ID)
+		return errors.New("Program " + program.ID + " only allows " + programCurrency + " paper")
+	}
+	if cp.Maturity < program.MinMaturity || cp.Maturity > program.MaxMaturity {
+		fmt.Println("Maturity outside program " + program.ID)
+		return errors.New("Program " + program.ID + " only allows maturities of " + strconv.Itoa(program.MinMaturity) + " to " + strconv.Itoa(program.MaxMaturity) + " days")
+	}
+
+	face := cp.Par * Money(cp.Qty)
+	if program.Outstanding + face > program.MaxOutstanding {
+		fmt.Println("Issue would breach program " + program.ID)
+		return errors.New("Issue would take program " + program.ID + " to " + (program.Outstanding + face).String() + " outstanding, above its limit of " + program.MaxOutstanding.String())
+	}
+
+	program.Outstanding += face
+	return putProgram(stub, program)
+}
+
+// releaseProgram takes quantity units of retired paper off its program's
+// outstanding total
+func releaseProgram(stub shim.ChaincodeStubInterface, cp CP, quantity int) error {
+	if cp.Program == "" {
+		return nil
+	}
+
+	program, err := GetProgram(cp.Program, stub)
+	if err != nil {
+		return err
+	}
+
+	program.Outstanding -= cp.Par * Money(quantity)
+	if program.Outstanding < 0 {
+		program.Outstanding = 0
+	}
+	return putProgram(stub, program)
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var proposalPrefix = "proposal:"
+var proposalSettingsKey = "ProposalSettings"
+
+// Proposal status values
+const (
+	proposalPending  = "pending"
+	proposalAccepted = "accepted"
+	proposalRejected = "rejected"
+	proposalExpired  = "expired"
+)
+
+// ProposalSettings holds how long a transfer proposal stays open
+type ProposalSettings struct {
+	ExpiryMinutes int `json:"expiryMinutes"`
+}
+
+var defaultProposalSettings = ProposalSettings{ExpiryMinutes: 24 * 60}
+
+// Proposal is a transfer proposed by the seller that only settles once the
+// buyer accepts it
+type Proposal struct {
+	ID        string `json:"id"`
+	Transaction
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	Expiry    string `json:"expiry"`
+	TradeID   string `json:"tradeId,omitempty"`
+}
+
+func GetProposalSettings(stub shim.ChaincodeStubInterface) (ProposalSettings, error) {
+	settings := defaultProposalSettings
+
+	settingsBytes, err := stub.GetState(proposalSettingsKey)
+	if err != nil {
+		fmt.Println("Error retrieving proposal settings")
+		return settings, errors.New("Error retrieving proposal settings")
+	}
+	if settingsBytes == nil {
+		return settings, nil
+	}
+
+	err = json.Unmarshal(settingsBytes, &settings)
+	if err != nil {
+		fmt.Println("Error unmarshalling proposal settings")
+		return settings, errors.New("Error unmarshalling proposal settings")
+	}
+
+	return settings, nil
+}
+
+func (t *SimpleChaincode) setProposalSettings(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Setting proposal settings")
+	/*		0
+		json
+	  	{
+			"expiryMinutes": 1440
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting proposal settings")
+	}
+
+	var settings ProposalSettings
+	err := json.Unmarshal([]byte(args[0]), &settings)
+	if err != nil {
+		fmt.Println("Error unmarshalling proposal settings")
+		return nil, errors.New("Invalid proposal settings")
+	}
+	if settings.ExpiryMinutes <= 0 {
+		return nil, errors.New("expiryMinutes must be positive")
+	}
+
+	settingsBytes, err := json.Marshal(&settings)
+	if err != nil {
+		fmt.Println("Error marshalling proposal settings")
+		return nil, errors.New("Error marshalling proposal settings")
+	}
+	err = stub.PutState(proposalSettingsKey, settingsBytes)
+	if err != nil {
+		fmt.Println("Error writing proposal settings")
+		return nil, errors.New("Error writing proposal settings")
+	}
+
+	fmt.Println("Proposal settings set")
+	return nil, nil
+}
+
+func GetProposal(proposalID string, stub shim.ChaincodeStubInterface) (Proposal, error) {
+	var proposal Proposal
+
+	proposalBytes, err := stub.GetState(proposalPrefix + proposalID)
+	if err != nil || proposalBytes == nil {
+		fmt.Println("Proposal not found " + proposalID)
+		return proposal, errors.New("Proposal not found " + proposalID)
+	}
+
+	err = json.Unmarshal(proposalBytes, &proposal)
+	if err != nil {
+		fmt.Println("Error unmarshalling proposal " + proposalID)
+		return proposal, errors.New("Error unmarshalling proposal " + proposalID)
+	}
+
+	return proposal, nil
+}
+
+func putProposal(stub shim.ChaincodeStubInterface, proposal Proposal) error {
+	proposalBytes, err := json.Marshal(&proposal)
+	if err != nil {
+		fmt.Println("Error marshalling proposal " + proposal.ID)
+		return errors.New("Error marshalling proposal " + proposal.ID)
+	}
+	err = stub.PutState(proposalPrefix + proposal.ID, proposalBytes)
+	if err != nil {
+		fmt.Println("Error writing proposal " + proposal.ID + " back")
+		return errors.New("Error writing proposal " + proposal.ID + " back")
+	}
+
+	return nil
+}
+
+// pastExpiry reports whether an expiry in milliseconds has passed
+func pastExpiry(expiry string, now time.Time) bool {
+	t, err := msToTime(expiry)
+	return err != nil || !now.Before(t)
+}
+
+// expireProposal marks a pending proposal expired once its expiry has passed
+func expireProposal(proposal *Proposal, now time.Time) {
+	if proposal.Status == proposalPending && pastExpiry(proposal.Expiry, now) {
+		proposal.Status = proposalExpired
+	}
+}
+
+// proposeTransfer records a transfer for the buyer to accept. Only the
+// seller named in the caller's certificate can propose it, and nothing moves
+// until it is accepted.
+func proposeTransfer(stub shim.ChaincodeStubInterface, tr Transaction) (Proposal, error) {
+	var proposal Proposal
+
+	seller, err := callerCompany(stub)
+	if err != nil {
+		return proposal, err
+	}
+	if seller != tr.FromCompany {
+		fmt.Println("The company " + seller + " can't propose a transfer from " + tr.FromCompany)
+		return proposal, errors.New("The company " + seller + " can't propose a transfer of " + tr.FromCompany + "'s paper")
+	}
+	if tr.FromCompany == tr.ToCompany {
+		fmt.Println("The company " + tr.FromCompany + " can't transfer paper to itself")
+		return proposal, errors.New("The company " + tr.FromCompany + " can't transfer paper to itself")
+	}
+	if tr.Quantity <= 0 {
+		return proposal, errors.New("Transfer quantity must be positive")
+	}
+	if tr.Discount != nil && (*tr.Discount < 0 || *tr.Discount >= 100 * rateScale) {
+		return proposal, errors.New("Transfer discount must be at least 0 and below 100")
+	}
+	if tr.Net && len(tr.Holds) > 0 {
+		return proposal, errors.New("Holds can only be consumed by a transfer that settles on its own, not by net settlement")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return proposal, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	// Catch what can be caught now, the rest is checked on acceptance
+	cp, err := GetCP(cpPrefix + tr.CUSIP, stub)
+	if err != nil {
+		return proposal, err
+	}
+	if tr.Currency != "" && tr.Currency != paperCurrency(cp) {
+		return proposal, errors.New("The paper " + tr.CUSIP + " settles in " + paperCurrency(cp) + ", not " + tr.Currency)
+	}
+	// Paper the seller put on hold for this transfer counts towards it. A
+	// net transfer only has to be covered by the seller's net position when
+	// the window settles.
+	if !tr.Net && available(cp, tr.FromCompany, now) + heldFor(cp, tr.FromCompany, tr.Holds, now) < tr.Quantity {
+		fmt.Println("The company " + tr.FromCompany + " doesn't own enough of this paper")
+		return proposal, errors.New("The company " + tr.FromCompany + " doesn't own enough of this paper")
+	}
+	_, err = GetCompany(tr.ToCompany, stub)
+	if err != nil {
+		return proposal, err
+	}
+
+	settings, err := GetProposalSettings(stub)
+	if err != nil {
+		return proposal, err
+	}
+
+	proposal = Proposal{
+		ID:          stub.GetTxID(),
+		Transaction: tr,
+		Status:      proposalPending,
+		Timestamp:   timeToMs(now),
+		Expiry:      timeToMs(now.Add(time.Duration(settings.ExpiryMinutes) * time.Minute)),
+	}
+	err = putProposal(stub, proposal)
+	if err != nil {
+		return proposal, err
+	}
+
+	fmt.Println("Proposed transfer " + proposal.ID + " of " + tr.CUSIP + " to " + tr.ToCompany)
+	return proposal, nil
+}
+
+// answerProposal loads a proposal addressed to the caller that is still
+// pending on the given date. Only the buyer named in the caller's
+// certificate can answer it.
+func answerProposal(stub shim.ChaincodeStubInterface, proposalID string, now time.Time) (Proposal, error) {
+	proposal, err := GetProposal(proposalID, stub)
+	if err != nil {
+		return proposal, err
+	}
+	buyer, err := callerCompany(stub)
+	if err != nil {
+		return proposal, err
+	}
+	if proposal.ToCompany != buyer {
+		fmt.Println("Proposal " + proposalID + " isn't addressed to " + buyer)
+		return proposal, errors.New("Proposal " + proposalID + " isn't addressed to " + buyer)
+	}
+	expireProposal(&proposal, now)
+	if proposal.Status != proposalPending {
+		fmt.Println("Proposal " + proposalID + " is " + proposal.Status)
+		return proposal, errors.New("Proposal " + proposalID + " is " + proposal.Status)
+	}
+
+	return proposal, nil
+}
+
+// settleProposal settles an accepted proposal in this transaction and
+// marks it accepted. A net transfer waits for the next net settlement as an
+// obligation instead.
+func settleProposal(stub shim.ChaincodeStubInterface, proposal Proposal, now time.Time) (Trade, error) {
+	var trade Trade
+	var err error
+	if proposal.Net {
+		trade, err = queueObligation(stub, proposal.Transaction, stub.GetTxID(), now)
+	} else {
+		trade, err = settleTransfer(stub, proposal.Transaction, stub.GetTxID(), now)
+	}
+	if err != nil {
+		return trade, err
+	}
+	proposal.Status = proposalAccepted
+	proposal.TradeID = trade.ID
+	err = putProposal(stub, proposal)
+	if err != nil {
+		return trade, err
+	}
+
+	fmt.Println("Accepted transfer " + proposal.ID)
+	return trade, nil
+}
+
+func (t *SimpleChaincode) acceptTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting transfer")
+	/*		0
+		proposal ID  (the buyer is the account in the caller's certificate)
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting proposal ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	proposal, err := answerProposal(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	trade, err := settleProposal(stub, proposal, now)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&trade)
+}
+
+func (t *SimpleChaincode) rejectTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Rejecting transfer")
+	/*		0
+		proposal ID  (the buyer is the account in the caller's certificate)
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting proposal ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	proposal, err := answerProposal(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	proposal.Status = proposalRejected
+	err = putProposal(stub, proposal)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rejected transfer " + proposal.ID)
+	return nil, nil
+}
+
+// GetProposals returns the transfer proposals the company is buyer or seller
+// on, only pending ones unless all is set. Proposals past their expiry are
+// shown as expired when the query has a timestamp.
+func GetProposals(companyID string, all bool, stub shim.ChaincodeStubInterface) ([]Proposal, error) {
+	proposals := []Proposal{}
+
+	iter, err := stub.RangeQueryState(proposalPrefix, proposalPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading proposals")
+		return nil, errors.New("Error reading proposals: " + err.Error())
+	}
+	defer iter.Close()
+
+	now, timeErr := txTime(stub)
+	for iter.HasNext() {
+		key, proposalBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading proposals: " + err.Error())
+		}
+		var proposal Proposal
+		err = json.Unmarshal(proposalBytes, &proposal)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+
+		if proposal.FromCompany != companyID && proposal.ToCompany != companyID {
+			continue
+		}
+		if timeErr == nil {
+			expireProposal(&proposal, now)
+		}
+		if !all && proposal.Status != proposalPending {
+			continue
+		}
+		proposals = append(proposals, proposal)
+	}
+
+	return proposals, nil
+}
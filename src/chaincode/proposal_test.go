@@ -0,0 +1,64 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTransferNeedsBothSides(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	transfer := toJSON(t, map[string]interface{}{
+		"CUSIP":       cusip,
+		"fromCompany": "company1",
+		"toCompany":   "company2",
+		"quantity":    3,
+	})
+
+	// Only the seller can propose
+	for _, caller := range []string{"company2", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "transferPaper", transfer)
+		if err == nil {
+			t.Errorf("%q proposed a transfer of company1's paper", caller)
+		}
+	}
+	var proposal Proposal
+	err := json.Unmarshal(mustInvoke(t, stub, cc, "company1", "transferPaper", transfer), &proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 10, "company2": 0})
+
+	// Only the buyer can accept
+	for _, caller := range []string{"company1", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "acceptTransfer", proposal.ID)
+		if err == nil {
+			t.Errorf("%q accepted a transfer to company2", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptTransfer", proposal.ID)
+
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 7, "company2": 3})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 299100,
+		"company2": initialCashBalance - 299100,
+	})
+}
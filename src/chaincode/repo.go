@@ -0,0 +1,570 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var repoPrefix = "repo:"
+
+// Repo status values, a repo is proposed by the borrower and opens when the
+// lender accepts it. Proposed repos also use the proposal status values.
+const (
+	repoOpen   = "open"
+	repoClosed = "closed"
+)
+
+// Repo is a repurchase agreement. The borrower delivers the collateral to
+// the lender against cash and buys it back when the repo closes, paying the
+// cash back with interest at the repo rate on an ACT/360 basis. While the
+// repo is open the collateral is encumbered in the lender's hands and can't
+// be transferred. Income is what the collateral paid the lender while it
+// was held, at maturity or as recovery, and is owed back to the borrower.
+type Repo struct {
+	ID        string `json:"id"`
+	CUSIP     string `json:"cusip"`
+	Borrower  string `json:"borrower"`
+	Lender    string `json:"lender"`
+	Quantity  int    `json:"quantity"`
+	Cash      Money  `json:"cash"`
+	Rate      Rate   `json:"rate"`
+	Term      int    `json:"term"`
+	Currency  string `json:"currency"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	Expiry    string `json:"expiry,omitempty"`
+	Start     string `json:"start,omitempty"`
+	End       string `json:"end,omitempty"`
+	Income    Money  `json:"income,omitempty"`
+	Interest  Money  `json:"interest,omitempty"`
+	Closed    string `json:"closed,omitempty"`
+}
+
+// repoHaircut is taken off what the collateral is worth to give the most
+// cash a repo can lend against it, as a percentage
+var repoHaircut = Rate(2 * rateScale)
+
+// moveQuantity moves quantity units of the paper between two holders
+func moveQuantity(cp *CP, from string, to string, quantity int) {
+	found := false
+	for key, owner := range cp.Owners {
+		if owner.Company == from {
+			cp.Owners[key].Quantity -= quantity
+		}
+		if owner.Company == to {
+			found = true
+			cp.Owners[key].Quantity += quantity
+		}
+	}
+	if !found {
+		cp.Owners = append(cp.Owners, Owner{Company: to, Quantity: quantity})
+	}
+}
+
+// moveCollateral moves repo collateral between two holders, encumbering it
+// in the lender's hands when the repo opens or releasing it when it closes
+func moveCollateral(cp *CP, from string, to string, quantity int, encumber bool) {
+	moveQuantity(cp, from, to, quantity)
+	for key, owner := range cp.Owners {
+		if encumber && owner.Company == to {
+			cp.Owners[key].Encumbered += quantity
+		}
+		if !encumber && owner.Company == from {
+			cp.Owners[key].Encumbered -= quantity
+		}
+	}
+}
+
+// repoInterest returns the interest on the repo cash from the start of the
+// repo to the given date
+func repoInterest(repo Repo, now time.Time) (Money, error) {
+	start, err := msToTime(repo.Start)
+	if err != nil {
+		return 0, errors.New("Invalid start date on repo " + repo.ID)
+	}
+	days := calendarDays(start, now)
+	if days < 0 {
+		days = 0
+	}
+	interest := new(big.Rat).Mul(repo.Cash.rat(), repo.Rate.fraction())
+	interest.Mul(interest, big.NewRat(int64(days), 360))
+	return moneyFromRat(interest), nil
+}
+
+// checkRepoCash makes sure the repo doesn't lend more than the collateral
+// is worth on the given date, less the haircut
+func checkRepoCash(cp CP, repo Repo, now time.Time) error {
+	value, err := buyInValue(cp, repo.Quantity, now)
+	if err != nil {
+		return err
+	}
+	limit := new(big.Rat).Sub(big.NewRat(1, 1), repoHaircut.fraction())
+	most := moneyFromRat(limit.Mul(limit, value.rat()))
+	if repo.Cash > most {
+		fmt.Println("Repo cash is more than the collateral is worth")
+		return errors.New("Repo cash of " + repo.Cash.String() + " is above the " + most.String() + " the collateral is worth after a " + repoHaircut.String() + "% haircut")
+	}
+
+	return nil
+}
+
+func GetRepo(repoID string, stub shim.ChaincodeStubInterface) (Repo, error) {
+	var repo Repo
+
+	repoBytes, err := stub.GetState(repoPrefix + repoID)
+	if err != nil || repoBytes == nil {
+		fmt.Println("Repo not found " + repoID)
+		return repo, errors.New("Repo not found " + repoID)
+	}
+
+	err = json.Unmarshal(repoBytes, &repo)
+	if err != nil {
+		fmt.Println("Error unmarshalling repo " + repoID)
+		return repo, errors.New("Error unmarshalling repo " + repoID)
+	}
+
+	return repo, nil
+}
+
+func putRepo(stub shim.ChaincodeStubInterface, repo Repo) error {
+	repoBytes, err := json.Marshal(&repo)
+	if err != nil {
+		fmt.Println("Error marshalling repo " + repo.ID)
+		return errors.New("Error marshalling repo " + repo.ID)
+	}
+	err = stub.PutState(repoPrefix + repo.ID, repoBytes)
+	if err != nil {
+		fmt.Println("Error writing repo " + repo.ID + " back")
+		return errors.New("Error writing repo " + repo.ID + " back")
+	}
+
+	return nil
+}
+
+// getRepos returns every repo in key order
+func getRepos(stub shim.ChaincodeStubInterface) ([]Repo, error) {
+	var repos []Repo
+
+	iter, err := stub.RangeQueryState(repoPrefix, repoPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading repos")
+		return nil, errors.New("Error reading repos: " + err.Error())
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		key, repoBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading repos: " + err.Error())
+		}
+		var repo Repo
+		err = json.Unmarshal(repoBytes, &repo)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
+
+// expireRepo marks a proposed repo expired once its expiry has passed
+func expireRepo(repo *Repo, now time.Time) {
+	if repo.Status == proposalPending && pastExpiry(repo.Expiry, now) {
+		repo.Status = proposalExpired
+	}
+}
+
+// passRepoIncome records on every open repo against the paper what the
+// lender was paid per unit of collateral, so it goes back to the borrower
+// when the repo closes
+func passRepoIncome(stub shim.ChaincodeStubInterface, cp CP, perUnit Money) error {
+	repos, err := getRepos(stub)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if repo.CUSIP != cp.CUSIP || repo.Status != repoOpen {
+			continue
+		}
+		repo.Income += perUnit * Money(repo.Quantity)
+		err = putRepo(stub, repo)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Repo " + repo.ID + " collateral paid " + repo.Income.String() + " " + repo.Currency + " so far")
+	}
+
+	return nil
+}
+
+func (t *SimpleChaincode) openRepo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Proposing repo")
+	/*		0
+		json
+	  	{
+			"cusip": "",
+			"lender": "company2",
+			"quantity": 5,
+			"cash": 4850.00, (at most what the collateral is worth less the haircut)
+			"rate": 2.5,
+			"term": 7  (days)
+		}
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting repo")
+	}
+
+	var repo Repo
+	err := json.Unmarshal([]byte(args[0]), &repo)
+	if err != nil {
+		fmt.Println("Error unmarshalling repo")
+		return nil, errors.New("Invalid repo")
+	}
+	// The borrower is the caller's account
+	repo.Borrower, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if repo.Borrower == repo.Lender {
+		return nil, errors.New("The company " + repo.Borrower + " can't repo paper with itself")
+	}
+	if repo.Quantity <= 0 {
+		return nil, errors.New("Repo quantity must be positive")
+	}
+	if repo.Cash <= 0 {
+		return nil, errors.New("Repo cash must be positive")
+	}
+	if repo.Rate < 0 || repo.Rate >= 100 * rateScale {
+		return nil, errors.New("Repo rate must be at least 0 and below 100")
+	}
+	if repo.Term <= 0 {
+		return nil, errors.New("Repo term must be at least one day")
+	}
+
+	// The collateral may mature during the repo, but it has to be running
+	// when the repo is agreed
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	cp, err := tradeablePaper(stub, repo.CUSIP, now)
+	if err != nil {
+		return nil, err
+	}
+	if available(cp, repo.Borrower, now) < repo.Quantity {
+		fmt.Println("The company " + repo.Borrower + " doesn't have enough of " + repo.CUSIP + " to deliver")
+		return nil, errors.New("The company " + repo.Borrower + " doesn't have enough of " + repo.CUSIP + " to deliver")
+	}
+	err = checkRepoCash(cp, repo, now)
+	if err != nil {
+		return nil, err
+	}
+	_, err = GetCompany(repo.Lender, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := GetProposalSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	repo.ID = stub.GetTxID()
+	repo.Currency = paperCurrency(cp)
+	repo.Status = proposalPending
+	repo.Timestamp = timeToMs(now)
+	repo.Expiry = timeToMs(now.Add(time.Duration(settings.ExpiryMinutes) * time.Minute))
+	repo.Start = ""
+	repo.End = ""
+	repo.Income = 0
+	repo.Interest = 0
+	repo.Closed = ""
+	err = putRepo(stub, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Proposed repo " + repo.ID + " of " + repo.CUSIP + " to " + repo.Lender)
+	return json.Marshal(&repo)
+}
+
+// answerRepo loads a proposed repo addressed to the caller that is still
+// pending on the given date. Only the lender named in the caller's
+// certificate can answer it.
+func answerRepo(stub shim.ChaincodeStubInterface, repoID string, now time.Time) (Repo, error) {
+	lender, err := callerCompany(stub)
+	if err != nil {
+		return Repo{}, err
+	}
+	repo, err := GetRepo(repoID, stub)
+	if err != nil {
+		return repo, err
+	}
+	if repo.Lender != lender {
+		fmt.Println("Repo " + repoID + " isn't addressed to " + lender)
+		return repo, errors.New("Repo " + repoID + " isn't addressed to " + lender)
+	}
+	expireRepo(&repo, now)
+	if repo.Status != proposalPending {
+		fmt.Println("Repo " + repoID + " is " + repo.Status)
+		return repo, errors.New("Repo " + repoID + " is " + repo.Status)
+	}
+
+	return repo, nil
+}
+
+func (t *SimpleChaincode) acceptRepo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting repo")
+	/*		0
+		repo ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting repo ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	repo, err := answerRepo(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := tradeablePaper(stub, repo.CUSIP, now)
+	if err != nil {
+		return nil, err
+	}
+	if available(cp, repo.Borrower, now) < repo.Quantity {
+		fmt.Println("The company " + repo.Borrower + " doesn't have enough of " + repo.CUSIP + " to deliver")
+		return nil, errors.New("The company " + repo.Borrower + " doesn't have enough of " + repo.CUSIP + " to deliver")
+	}
+	// The collateral may have moved in price since the repo was proposed
+	err = checkRepoCash(cp, repo, now)
+	if err != nil {
+		return nil, err
+	}
+	borrower, err := GetCompany(repo.Borrower, stub)
+	if err != nil {
+		return nil, err
+	}
+	lender, err := GetCompany(repo.Lender, stub)
+	if err != nil {
+		return nil, err
+	}
+	if availableCash(lender, repo.Currency, now) < repo.Cash {
+		fmt.Println("The company " + repo.Lender + " doesn't have enough cash for the repo")
+		return nil, errors.New("The company " + repo.Lender + " doesn't have enough " + repo.Currency + " cash to lend " + repo.Cash.String())
+	}
+
+	// Collateral goes to the lender, encumbered, and cash to the borrower
+	moveCollateral(&cp, repo.Borrower, repo.Lender, repo.Quantity, true)
+	addCash(&lender, repo.Currency, -repo.Cash)
+	addCash(&borrower, repo.Currency, repo.Cash)
+	lender.AssetsIds = append(lender.AssetsIds, repo.CUSIP)
+
+	repo.Status = repoOpen
+	repo.Start = timeToMs(now)
+	repo.End = timeToMs(now.AddDate(0, 0, repo.Term))
+
+	// Write everything back
+	err = putCompany(stub, borrower)
+	if err != nil {
+		return nil, err
+	}
+	err = putCompany(stub, lender)
+	if err != nil {
+		return nil, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+	err = putRepo(stub, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Opened repo " + repo.ID)
+	return json.Marshal(&repo)
+}
+
+func (t *SimpleChaincode) rejectRepo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Rejecting repo")
+	/*		0
+		repo ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting repo ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	repo, err := answerRepo(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.Status = proposalRejected
+	err = putRepo(stub, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rejected repo " + repo.ID)
+	return nil, nil
+}
+
+func (t *SimpleChaincode) closeRepo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Closing repo")
+	/*		0
+		repo ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting repo ID")
+	}
+
+	// The caller has to be the borrower, or the lender once the term is up
+	company, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := GetRepo(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+	if repo.Status != repoOpen {
+		fmt.Println("Repo " + repo.ID + " is " + repo.Status)
+		return nil, errors.New("Repo " + repo.ID + " is " + repo.Status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	// The borrower can buy back early, the lender only once the term is up
+	if company != repo.Borrower && company != repo.Lender {
+		return nil, errors.New("The company " + company + " isn't party to repo " + repo.ID)
+	}
+	if company == repo.Lender && !pastExpiry(repo.End, now) {
+		end, _ := msToTime(repo.End)
+		return nil, errors.New("Repo " + repo.ID + " runs until " + end.UTC().Format("2006-01-02") + " and only the borrower can close it early")
+	}
+
+	repo.Interest, err = repoInterest(repo, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// The borrower repays the cash with interest and the lender hands back
+	// the collateral along with anything it paid while held. Only the net
+	// amount moves.
+	cp, err := GetCP(cpPrefix + repo.CUSIP, stub)
+	if err != nil {
+		return nil, err
+	}
+	borrower, err := GetCompany(repo.Borrower, stub)
+	if err != nil {
+		return nil, err
+	}
+	lender, err := GetCompany(repo.Lender, stub)
+	if err != nil {
+		return nil, err
+	}
+	net := repo.Cash + repo.Interest - repo.Income
+	if net > 0 && availableCash(borrower, repo.Currency, now) < net {
+		fmt.Println("The company " + repo.Borrower + " doesn't have enough cash to close the repo")
+		return nil, errors.New("The company " + repo.Borrower + " doesn't have enough " + repo.Currency + " cash to repay " + net.String())
+	}
+	if net < 0 && availableCash(lender, repo.Currency, now) < -net {
+		fmt.Println("The company " + repo.Lender + " doesn't have enough cash to close the repo")
+		return nil, errors.New("The company " + repo.Lender + " doesn't have enough " + repo.Currency + " cash to pay back " + (-net).String() + " of collateral income")
+	}
+	addCash(&borrower, repo.Currency, -net)
+	addCash(&lender, repo.Currency, net)
+	moveCollateral(&cp, repo.Lender, repo.Borrower, repo.Quantity, false)
+
+	repo.Status = repoClosed
+	repo.Closed = timeToMs(now)
+
+	// Write everything back
+	err = putCompany(stub, borrower)
+	if err != nil {
+		return nil, err
+	}
+	err = putCompany(stub, lender)
+	if err != nil {
+		return nil, err
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return nil, err
+	}
+	err = putRepo(stub, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Closed repo " + repo.ID + " with interest of " + repo.Interest.String() + " " + repo.Currency)
+	return json.Marshal(&repo)
+}
+
+// GetRepos returns the repos the company is borrower or lender on, only
+// proposed and open ones unless all is set
+func GetRepos(companyID string, all bool, stub shim.ChaincodeStubInterface) ([]Repo, error) {
+	repos := []Repo{}
+
+	allRepos, err := getRepos(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, timeErr := txTime(stub)
+	for _, repo := range allRepos {
+		if repo.Borrower != companyID && repo.Lender != companyID {
+			continue
+		}
+		if timeErr == nil {
+			expireRepo(&repo, now)
+		}
+		if !all && repo.Status != proposalPending && repo.Status != repoOpen {
+			continue
+		}
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRepoParties(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	proposal := func(cash float64) string {
+		return toJSON(t, map[string]interface{}{
+			"cusip":    cusip,
+			"lender":   "company2",
+			"quantity": 5,
+			"cash":     cash,
+			"rate":     2.5,
+			"term":     7,
+		})
+	}
+
+	// The borrower is whoever proposes, and the cash can't be more than
+	// the collateral is worth after the haircut
+	_, err := invoke(stub, cc, "company3", "openRepo", proposal(4850.00))
+	if err == nil {
+		t.Error("company3 repoed paper it doesn't hold")
+	}
+	_, err = invoke(stub, cc, "company1", "openRepo", proposal(4950.00))
+	if err == nil {
+		t.Error("a repo lent more than the collateral is worth")
+	}
+	var repo Repo
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company1", "openRepo", proposal(4850.00)), &repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Borrower != "company1" {
+		t.Fatalf("repo borrowed by %q, want company1", repo.Borrower)
+	}
+
+	// Only the lender can accept
+	for _, caller := range []string{"company1", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "acceptRepo", repo.ID)
+		if err == nil {
+			t.Errorf("%q accepted a repo with company2", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptRepo", repo.ID)
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 5, "company2": 5})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 485000,
+		"company2": initialCashBalance - 485000,
+	})
+
+	// The lender can't close before the term is up, nor can anyone else
+	stub.now = stub.now.Add(3 * 24 * time.Hour)
+	for _, caller := range []string{"company2", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "closeRepo", repo.ID)
+		if err == nil {
+			t.Errorf("%q closed the repo early", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company1", "closeRepo", repo.ID)
+
+	// Three days of interest at 2.5% on the cash goes to the lender
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 10, "company2": 0})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance - 101,
+		"company2": initialCashBalance + 101,
+	})
+}
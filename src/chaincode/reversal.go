@@ -0,0 +1,471 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var reversalPrefix = "reversal:"
+
+// Reversal is a request by one counterparty to a trade to undo it. It is
+// applied once the other counterparty approves it, and uses the proposal
+// status values and expiry.
+type Reversal struct {
+	ID        string `json:"id"`
+	TradeID   string `json:"tradeId"`
+	Requester string `json:"requester"`
+	Approver  string `json:"approver"`
+	Reason    string `json:"reason,omitempty"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	Expiry    string `json:"expiry"`
+	// ReversingTrade is the trade that undid the original once approved
+	ReversingTrade string `json:"reversingTrade,omitempty"`
+}
+
+func GetReversal(reversalID string, stub shim.ChaincodeStubInterface) (Reversal, error) {
+	var reversal Reversal
+
+	reversalBytes, err := stub.GetState(reversalPrefix + reversalID)
+	if err != nil || reversalBytes == nil {
+		fmt.Println("Reversal not found " + reversalID)
+		return reversal, errors.New("Reversal not found " + reversalID)
+	}
+
+	err = json.Unmarshal(reversalBytes, &reversal)
+	if err != nil {
+		fmt.Println("Error unmarshalling reversal " + reversalID)
+		return reversal, errors.New("Error unmarshalling reversal " + reversalID)
+	}
+
+	return reversal, nil
+}
+
+func putReversal(stub shim.ChaincodeStubInterface, reversal Reversal) error {
+	reversalBytes, err := json.Marshal(&reversal)
+	if err != nil {
+		fmt.Println("Error marshalling reversal " + reversal.ID)
+		return errors.New("Error marshalling reversal " + reversal.ID)
+	}
+	err = stub.PutState(reversalPrefix + reversal.ID, reversalBytes)
+	if err != nil {
+		fmt.Println("Error writing reversal " + reversal.ID + " back")
+		return errors.New("Error writing reversal " + reversal.ID + " back")
+	}
+
+	return nil
+}
+
+// expireReversal marks a pending reversal expired once its expiry has passed
+func expireReversal(reversal *Reversal, now time.Time) {
+	if reversal.Status == proposalPending && pastExpiry(reversal.Expiry, now) {
+		reversal.Status = proposalExpired
+	}
+}
+
+// getReversals reads every reversal, with pending ones past their expiry
+// shown as expired
+func getReversals(stub shim.ChaincodeStubInterface, now time.Time) ([]Reversal, error) {
+	var reversals []Reversal
+
+	iter, err := stub.RangeQueryState(reversalPrefix, reversalPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading reversals")
+		return nil, errors.New("Error reading reversals: " + err.Error())
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		key, reversalBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading reversals: " + err.Error())
+		}
+		var reversal Reversal
+		err = json.Unmarshal(reversalBytes, &reversal)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+		expireReversal(&reversal, now)
+		reversals = append(reversals, reversal)
+	}
+
+	return reversals, nil
+}
+
+// reversible checks that a trade can still be reversed, which it can only
+// be once and only while the paper is running
+func reversible(stub shim.ChaincodeStubInterface, trade Trade) error {
+	if trade.ReversedBy != "" {
+		fmt.Println("Trade " + trade.ID + " has already been reversed")
+		return errors.New("Trade " + trade.ID + " has already been reversed by " + trade.ReversedBy)
+	}
+	if trade.Reverses != "" {
+		return errors.New("Trade " + trade.ID + " reverses " + trade.Reverses + " and can't itself be reversed")
+	}
+	cp, err := GetCP(cpPrefix + trade.CUSIP, stub)
+	if err != nil {
+		return err
+	}
+	if cp.Status == paperMatured || cp.Status == paperDefaulted {
+		fmt.Println("The paper " + trade.CUSIP + " is " + cp.Status)
+		return errors.New("The paper " + trade.CUSIP + " is " + cp.Status + " and trades in it can no longer be reversed")
+	}
+	return nil
+}
+
+// reverseTrade moves the quantity of a trade back to the seller and the
+// cash back to the buyer, with the operator handing back the transfer fee.
+// The reversing trade is recorded under tradeID and linked to the original.
+func reverseTrade(stub shim.ChaincodeStubInterface, trade Trade, tradeID string, now time.Time) (Trade, error) {
+	var reversing Trade
+
+	cp, err := GetCP(cpPrefix + trade.CUSIP, stub)
+	if err != nil {
+		return reversing, err
+	}
+	seller, err := GetCompany(trade.FromCompany, stub)
+	if err != nil {
+		return reversing, err
+	}
+	buyer, err := GetCompany(trade.ToCompany, stub)
+	if err != nil {
+		return reversing, err
+	}
+
+	// The fee goes back from whoever it was credited to
+	var refund FeeRecord
+	var operator *Account
+	if trade.Fee != 0 {
+		record, err := GetFeeRecord(trade.ID, stub)
+		if err != nil {
+			return reversing, err
+		}
+		if record.Operator == "" {
+			schedule, err := GetFeeSchedule(stub)
+			if err != nil {
+				return reversing, err
+			}
+			record.Operator = schedule.Operator
+		}
+		if record.Operator == seller.ID {
+			operator = &seller
+		} else if record.Operator == buyer.ID {
+			operator = &buyer
+		} else {
+			account, err := GetCompany(record.Operator, stub)
+			if err != nil {
+				return reversing, err
+			}
+			operator = &account
+		}
+		refund = FeeRecord{
+			ID:        tradeID,
+			Kind:      feeRefund,
+			Payer:     record.Payer,
+			CUSIP:     record.CUSIP,
+			Currency:  record.Currency,
+			Basis:     record.Basis,
+			Amount:    -record.Amount,
+			Operator:  record.Operator,
+			Timestamp: timeToMs(now),
+		}
+		if availableCash(*operator, refund.Currency, now) < record.Amount {
+			fmt.Println("The operator " + operator.ID + " can't refund the fee")
+			return reversing, errors.New("The operator " + operator.ID + " doesn't have enough " + refund.Currency + " cash to refund the fee of " + record.Amount.String())
+		}
+		addCash(operator, refund.Currency, -record.Amount)
+		addCash(&seller, refund.Currency, record.Amount)
+	}
+
+	if available(cp, trade.ToCompany, now) < trade.Quantity {
+		fmt.Println("The company " + trade.ToCompany + " no longer has the paper to hand back")
+		return reversing, errors.New("The company " + trade.ToCompany + " doesn't have " + strconv.Itoa(trade.Quantity) + " of " + trade.CUSIP + " free to hand back")
+	}
+	// The seller hands back the whole amount, the refund makes up the fee
+	if availableCash(seller, trade.Currency, now) < trade.Amount {
+		fmt.Println("The company " + trade.FromCompany + " can't hand back the cash")
+		return reversing, errors.New("The company " + trade.FromCompany + " doesn't have enough " + trade.Currency + " cash to hand back " + trade.Amount.String())
+	}
+	addCash(&seller, trade.Currency, -trade.Amount)
+	addCash(&buyer, trade.Currency, trade.Amount)
+	moveQuantity(&cp, trade.ToCompany, trade.FromCompany, trade.Quantity)
+
+	reversing = Trade{
+		ID:          tradeID,
+		CUSIP:       trade.CUSIP,
+		FromCompany: trade.ToCompany,
+		ToCompany:   trade.FromCompany,
+		Quantity:    trade.Quantity,
+		Discount:    trade.Discount,
+		Amount:      trade.Amount,
+		Currency:    trade.Currency,
+		Reverses:    trade.ID,
+		Timestamp:   timeToMs(now),
+	}
+	trade.ReversedBy = reversing.ID
+	seller.TradeIds = append(seller.TradeIds, reversing.ID)
+	buyer.TradeIds = append(buyer.TradeIds, reversing.ID)
+
+	// Write everything back
+	err = putCompany(stub, seller)
+	if err != nil {
+		return reversing, err
+	}
+	err = putCompany(stub, buyer)
+	if err != nil {
+		return reversing, err
+	}
+	if operator != nil && operator != &seller && operator != &buyer {
+		err = putCompany(stub, *operator)
+		if err != nil {
+			return reversing, err
+		}
+	}
+	if trade.Fee != 0 {
+		err = putFeeRecord(stub, refund)
+		if err != nil {
+			return reversing, err
+		}
+	}
+	err = putCP(stub, cp)
+	if err != nil {
+		return reversing, err
+	}
+	err = putTrade(stub, trade)
+	if err != nil {
+		return reversing, err
+	}
+	err = putTrade(stub, reversing)
+	if err != nil {
+		return reversing, err
+	}
+
+	return reversing, nil
+}
+
+func (t *SimpleChaincode) requestReversal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Requesting reversal")
+	/*		0
+		json
+	  	{
+			"tradeId": "",  (the transaction ID the trade settled in)
+			"reason": "string"
+		}
+	*/
+	// The requester is the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting reversal")
+	}
+
+	var reversal Reversal
+	err := json.Unmarshal([]byte(args[0]), &reversal)
+	if err != nil {
+		fmt.Println("Error unmarshalling reversal")
+		return nil, errors.New("Invalid reversal")
+	}
+	reversal.Requester, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	trade, err := GetTrade(reversal.TradeID, stub)
+	if err != nil {
+		return nil, err
+	}
+	// The requester approves by asking, the other side still has to
+	if reversal.Requester == trade.FromCompany {
+		reversal.Approver = trade.ToCompany
+	} else if reversal.Requester == trade.ToCompany {
+		reversal.Approver = trade.FromCompany
+	} else {
+		fmt.Println("The company " + reversal.Requester + " isn't a counterparty to trade " + trade.ID)
+		return nil, errors.New("The company " + reversal.Requester + " isn't a counterparty to trade " + trade.ID)
+	}
+	err = reversible(stub, trade)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	reversals, err := getReversals(stub, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range reversals {
+		if other.TradeID == trade.ID && other.Status == proposalPending {
+			fmt.Println("Trade " + trade.ID + " already has a reversal pending")
+			return nil, errors.New("Trade " + trade.ID + " already has reversal " + other.ID + " pending")
+		}
+	}
+
+	settings, err := GetProposalSettings(stub)
+	if err != nil {
+		return nil, err
+	}
+	reversal.ID = stub.GetTxID()
+	reversal.Status = proposalPending
+	reversal.Timestamp = timeToMs(now)
+	reversal.Expiry = timeToMs(now.Add(time.Duration(settings.ExpiryMinutes) * time.Minute))
+	reversal.ReversingTrade = ""
+	err = putReversal(stub, reversal)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Requested reversal " + reversal.ID + " of trade " + trade.ID)
+	return json.Marshal(&reversal)
+}
+
+// answerReversal loads a reversal waiting on the caller that is still
+// pending on the given date. Only the approver named in the caller's
+// certificate can answer it.
+func answerReversal(stub shim.ChaincodeStubInterface, reversalID string, now time.Time) (Reversal, error) {
+	approver, err := callerCompany(stub)
+	if err != nil {
+		return Reversal{}, err
+	}
+	reversal, err := GetReversal(reversalID, stub)
+	if err != nil {
+		return reversal, err
+	}
+	if reversal.Approver != approver {
+		fmt.Println("Reversal " + reversalID + " isn't waiting on " + approver)
+		return reversal, errors.New("Reversal " + reversalID + " isn't waiting on " + approver)
+	}
+	expireReversal(&reversal, now)
+	if reversal.Status != proposalPending {
+		fmt.Println("Reversal " + reversalID + " is " + reversal.Status)
+		return reversal, errors.New("Reversal " + reversalID + " is " + reversal.Status)
+	}
+
+	return reversal, nil
+}
+
+func (t *SimpleChaincode) approveReversal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Approving reversal")
+	/*		0
+		reversal ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting reversal ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	reversal, err := answerReversal(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+	trade, err := GetTrade(reversal.TradeID, stub)
+	if err != nil {
+		return nil, err
+	}
+	err = reversible(stub, trade)
+	if err != nil {
+		return nil, err
+	}
+
+	reversing, err := reverseTrade(stub, trade, stub.GetTxID(), now)
+	if err != nil {
+		return nil, err
+	}
+	reversal.Status = proposalAccepted
+	reversal.ReversingTrade = reversing.ID
+	err = putReversal(stub, reversal)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Reversed trade " + trade.ID + " with " + reversing.ID)
+	return json.Marshal(&reversing)
+}
+
+func (t *SimpleChaincode) rejectReversal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Rejecting reversal")
+	/*		0
+		reversal ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting reversal ID")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	reversal, err := answerReversal(stub, args[0], now)
+	if err != nil {
+		return nil, err
+	}
+
+	reversal.Status = proposalRejected
+	err = putReversal(stub, reversal)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rejected reversal " + reversal.ID)
+	return nil, nil
+}
+
+// GetReversals returns the reversals of trades the company was a
+// counterparty to, only pending ones unless all is set
+func GetReversals(companyID string, all bool, stub shim.ChaincodeStubInterface) ([]Reversal, error) {
+	reversals := []Reversal{}
+
+	// Without a timestamp nothing is shown as expired
+	now, err := txTime(stub)
+	if err != nil {
+		now = time.Time{}
+	}
+	stored, err := getReversals(stub, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, reversal := range stored {
+		if reversal.Requester != companyID && reversal.Approver != companyID {
+			continue
+		}
+		if !all && reversal.Status != proposalPending {
+			continue
+		}
+		reversals = append(reversals, reversal)
+	}
+
+	return reversals, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestReversalParties(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	var proposal Proposal
+	err := json.Unmarshal(mustInvoke(t, stub, cc, "company1", "transferPaper", toJSON(t, map[string]interface{}{
+		"CUSIP":       cusip,
+		"fromCompany": "company1",
+		"toCompany":   "company2",
+		"quantity":    3,
+	})), &proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trade Trade
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company2", "acceptTransfer", proposal.ID), &trade)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := toJSON(t, map[string]interface{}{
+		"tradeId": trade.ID,
+		"reason":  "wrong account",
+	})
+
+	// Only a counterparty can ask for the reversal
+	for _, caller := range []string{"company3", ""} {
+		_, err := invoke(stub, cc, caller, "requestReversal", request)
+		if err == nil {
+			t.Errorf("%q asked to reverse a trade it isn't party to", caller)
+		}
+	}
+	var reversal Reversal
+	err = json.Unmarshal(mustInvoke(t, stub, cc, "company2", "requestReversal", request), &reversal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversal.Requester != "company2" || reversal.Approver != "company1" {
+		t.Fatalf("reversal asked by %q of %q, want company2 of company1", reversal.Requester, reversal.Approver)
+	}
+
+	// Only the other side can approve
+	for _, caller := range []string{"company2", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "approveReversal", reversal.ID)
+		if err == nil {
+			t.Errorf("%q approved a reversal waiting on company1", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company1", "approveReversal", reversal.ID)
+
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 10, "company2": 0})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance,
+		"company2": initialCashBalance,
+	})
+}
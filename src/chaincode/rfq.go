@@ -0,0 +1,523 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var rfqPrefix = "rfq:"
+
+// RFQ and quote status values
+const (
+	rfqOpen       = "open"
+	rfqAccepted   = "accepted"
+	rfqCancelled  = "cancelled"
+	quoteOpen     = "open"
+	quoteAccepted = "accepted"
+	quoteExpired  = "expired"
+	quoteLost     = "lost"
+	quoteReplaced = "replaced"
+)
+
+// DealerQuote is a dealer's offer to sell the requested quantity at a
+// discount until its expiry
+type DealerQuote struct {
+	ID        string `json:"id"`
+	Dealer    string `json:"dealer"`
+	Discount  Rate   `json:"discount"`
+	Expiry    string `json:"expiry"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// RFQEvent is one step in the life of an RFQ
+type RFQEvent struct {
+	Timestamp string `json:"timestamp"`
+	Event     string `json:"event"`
+	Company   string `json:"company"`
+	Quote     string `json:"quote,omitempty"`
+}
+
+// RFQ is a buyer's request to the invited dealers for quotes on a quantity
+// of paper, with every quote it received and its full history
+type RFQ struct {
+	ID        string        `json:"id"`
+	CUSIP     string        `json:"cusip"`
+	Buyer     string        `json:"buyer"`
+	Quantity  int           `json:"quantity"`
+	Dealers   []string      `json:"dealers"`
+	Status    string        `json:"status"`
+	Quotes    []DealerQuote `json:"quotes"`
+	TradeID   string        `json:"tradeId,omitempty"`
+	History   []RFQEvent    `json:"history"`
+}
+
+func GetRFQ(rfqID string, stub shim.ChaincodeStubInterface) (RFQ, error) {
+	var rfq RFQ
+
+	rfqBytes, err := stub.GetState(rfqPrefix + rfqID)
+	if err != nil || rfqBytes == nil {
+		fmt.Println("RFQ not found " + rfqID)
+		return rfq, errors.New("RFQ not found " + rfqID)
+	}
+
+	err = json.Unmarshal(rfqBytes, &rfq)
+	if err != nil {
+		fmt.Println("Error unmarshalling RFQ " + rfqID)
+		return rfq, errors.New("Error unmarshalling RFQ " + rfqID)
+	}
+
+	return rfq, nil
+}
+
+func putRFQ(stub shim.ChaincodeStubInterface, rfq RFQ) error {
+	rfqBytes, err := json.Marshal(&rfq)
+	if err != nil {
+		fmt.Println("Error marshalling RFQ " + rfq.ID)
+		return errors.New("Error marshalling RFQ " + rfq.ID)
+	}
+	err = stub.PutState(rfqPrefix + rfq.ID, rfqBytes)
+	if err != nil {
+		fmt.Println("Error writing RFQ " + rfq.ID + " back")
+		return errors.New("Error writing RFQ " + rfq.ID + " back")
+	}
+
+	return nil
+}
+
+// logRFQ adds an event to the RFQ's history
+func logRFQ(rfq *RFQ, now time.Time, event string, company string, quoteID string) {
+	rfq.History = append(rfq.History, RFQEvent{Timestamp: timeToMs(now), Event: event, Company: company, Quote: quoteID})
+}
+
+// expireQuotes closes every open quote whose expiry has passed
+func expireQuotes(rfq *RFQ, now time.Time) {
+	for i, quote := range rfq.Quotes {
+		if quote.Status != quoteOpen {
+			continue
+		}
+		expiry, err := msToTime(quote.Expiry)
+		if err != nil || !now.Before(expiry) {
+			rfq.Quotes[i].Status = quoteExpired
+			logRFQ(rfq, now, quoteExpired, quote.Dealer, quote.ID)
+		}
+	}
+}
+
+// tradeablePaper loads a paper and checks it is still running on the given
+// date
+func tradeablePaper(stub shim.ChaincodeStubInterface, cusip string, now time.Time) (CP, error) {
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		return cp, err
+	}
+	if cp.Status == paperMatured || cp.Status == paperDefaulted {
+		fmt.Println("The paper " + cusip + " is " + cp.Status)
+		return cp, errors.New("The paper " + cusip + " is " + cp.Status + " and can't be traded")
+	}
+	_, err = daysToMaturity(cp, now)
+	if err != nil {
+		return cp, err
+	}
+
+	return cp, nil
+}
+
+func (t *SimpleChaincode) openRFQ(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Opening RFQ")
+	/*		0
+		json
+	  	{
+			"cusip": "",
+			"quantity": 5,
+			"dealers": ["company2", "company3"]
+		}
+	*/
+	// The buyer is the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting RFQ")
+	}
+
+	var rfq RFQ
+	err := json.Unmarshal([]byte(args[0]), &rfq)
+	if err != nil {
+		fmt.Println("Error unmarshalling RFQ")
+		return nil, errors.New("Invalid RFQ")
+	}
+	rfq.Buyer, err = callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if rfq.Quantity <= 0 {
+		return nil, errors.New("RFQ quantity must be positive")
+	}
+	if len(rfq.Dealers) == 0 {
+		return nil, errors.New("An RFQ must invite at least one dealer")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	_, err = tradeablePaper(stub, rfq.CUSIP, now)
+	if err != nil {
+		return nil, err
+	}
+	_, err = GetCompany(rfq.Buyer, stub)
+	if err != nil {
+		return nil, err
+	}
+	for i, dealer := range rfq.Dealers {
+		if dealer == rfq.Buyer {
+			return nil, errors.New("The buyer " + rfq.Buyer + " can't be invited to quote")
+		}
+		for _, other := range rfq.Dealers[:i] {
+			if other == dealer {
+				return nil, errors.New("The dealer " + dealer + " is invited more than once")
+			}
+		}
+		_, err = GetCompany(dealer, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rfq.ID = stub.GetTxID()
+	rfq.Status = rfqOpen
+	rfq.Quotes = []DealerQuote{}
+	rfq.TradeID = ""
+	rfq.History = nil
+	logRFQ(&rfq, now, rfqOpen, rfq.Buyer, "")
+
+	err = putRFQ(stub, rfq)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Opened RFQ " + rfq.ID)
+	return []byte(rfq.ID), nil
+}
+
+func (t *SimpleChaincode) submitQuote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Submitting quote")
+	/*		0
+		json
+	  	{
+			"rfq": "RFQ ID",
+			"discount": 7.5,
+			"expiry": "1456161763790"  (time in milliseconds the quote is good until)
+		}
+	*/
+	// The dealer is the caller's account
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting quote")
+	}
+
+	var request struct {
+		RFQ      string `json:"rfq"`
+		Discount Rate   `json:"discount"`
+		Expiry   string `json:"expiry"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		fmt.Println("Error unmarshalling quote")
+		return nil, errors.New("Invalid quote")
+	}
+	dealer, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if request.Discount < 0 || request.Discount >= 100 * rateScale {
+		return nil, errors.New("Quote discount must be at least 0 and below 100")
+	}
+
+	rfq, err := GetRFQ(request.RFQ, stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+	expiry, err := msToTime(request.Expiry)
+	if err != nil {
+		return nil, errors.New("Invalid quote expiry " + request.Expiry)
+	}
+	if !expiry.After(now) {
+		return nil, errors.New("Quote expiry must be in the future")
+	}
+	if rfq.Status != rfqOpen {
+		fmt.Println("RFQ " + rfq.ID + " is " + rfq.Status)
+		return nil, errors.New("RFQ " + rfq.ID + " is " + rfq.Status + " and can't be quoted")
+	}
+
+	invited := false
+	for _, other := range rfq.Dealers {
+		if other == dealer {
+			invited = true
+		}
+	}
+	if !invited {
+		fmt.Println("The dealer " + dealer + " isn't invited to RFQ " + rfq.ID)
+		return nil, errors.New("The dealer " + dealer + " isn't invited to quote on RFQ " + rfq.ID)
+	}
+
+	cp, err := tradeablePaper(stub, rfq.CUSIP, now)
+	if err != nil {
+		return nil, err
+	}
+	if available(cp, dealer, now) < rfq.Quantity {
+		fmt.Println("The dealer " + dealer + " doesn't hold enough of " + rfq.CUSIP)
+		return nil, errors.New("The dealer " + dealer + " doesn't hold enough of " + rfq.CUSIP + " to quote")
+	}
+
+	// A new quote from a dealer replaces its open one
+	expireQuotes(&rfq, now)
+	for i, quote := range rfq.Quotes {
+		if quote.Dealer == dealer && quote.Status == quoteOpen {
+			rfq.Quotes[i].Status = quoteReplaced
+			logRFQ(&rfq, now, quoteReplaced, quote.Dealer, quote.ID)
+		}
+	}
+
+	quote := DealerQuote{
+		ID:        stub.GetTxID(),
+		Dealer:    dealer,
+		Discount:  request.Discount,
+		Expiry:    timeToMs(expiry),
+		Status:    quoteOpen,
+		Timestamp: timeToMs(now),
+	}
+	rfq.Quotes = append(rfq.Quotes, quote)
+	logRFQ(&rfq, now, "quoted", quote.Dealer, quote.ID)
+
+	err = putRFQ(stub, rfq)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Submitted quote " + quote.ID + " on RFQ " + rfq.ID)
+	return []byte(quote.ID), nil
+}
+
+func (t *SimpleChaincode) acceptQuote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accepting quote")
+	/*		0
+		json
+	  	{
+			"rfq": "RFQ ID",
+			"quote": "quote ID"
+		}
+	*/
+	// Only the buyer that opened the RFQ can accept a quote on it
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting quote acceptance")
+	}
+
+	var request struct {
+		RFQ   string `json:"rfq"`
+		Quote string `json:"quote"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		fmt.Println("Error unmarshalling quote acceptance")
+		return nil, errors.New("Invalid quote acceptance")
+	}
+	buyer, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	rfq, err := GetRFQ(request.RFQ, stub)
+	if err != nil {
+		return nil, err
+	}
+	if rfq.Buyer != buyer {
+		fmt.Println("RFQ " + rfq.ID + " doesn't belong to " + buyer)
+		return nil, errors.New("RFQ " + rfq.ID + " doesn't belong to " + buyer)
+	}
+	if rfq.Status != rfqOpen {
+		fmt.Println("RFQ " + rfq.ID + " is " + rfq.Status)
+		return nil, errors.New("RFQ " + rfq.ID + " is " + rfq.Status + " and can't be accepted")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	expireQuotes(&rfq, now)
+	accepted := -1
+	for i, quote := range rfq.Quotes {
+		if quote.ID == request.Quote {
+			accepted = i
+		}
+	}
+	if accepted == -1 {
+		fmt.Println("Quote not found " + request.Quote)
+		return nil, errors.New("Quote " + request.Quote + " not found on RFQ " + rfq.ID)
+	}
+	quote := rfq.Quotes[accepted]
+	if quote.Status != quoteOpen {
+		fmt.Println("Quote " + quote.ID + " is " + quote.Status)
+		return nil, errors.New("Quote " + quote.ID + " is " + quote.Status + " and can't be accepted")
+	}
+
+	discount := quote.Discount
+	trade, err := settleTransfer(stub, Transaction{
+		CUSIP:       rfq.CUSIP,
+		FromCompany: quote.Dealer,
+		ToCompany:   rfq.Buyer,
+		Quantity:    rfq.Quantity,
+		Discount:    &discount,
+	}, stub.GetTxID(), now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every other quote still open loses
+	for i := range rfq.Quotes {
+		if i == accepted {
+			rfq.Quotes[i].Status = quoteAccepted
+			logRFQ(&rfq, now, quoteAccepted, rfq.Buyer, quote.ID)
+		} else if rfq.Quotes[i].Status == quoteOpen {
+			rfq.Quotes[i].Status = quoteLost
+			logRFQ(&rfq, now, quoteLost, rfq.Quotes[i].Dealer, rfq.Quotes[i].ID)
+		}
+	}
+	rfq.Status = rfqAccepted
+	rfq.TradeID = trade.ID
+
+	err = putRFQ(stub, rfq)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Accepted quote " + quote.ID + " on RFQ " + rfq.ID)
+	return json.Marshal(&trade)
+}
+
+func (t *SimpleChaincode) cancelRFQ(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Cancelling RFQ")
+	/*		0
+		RFQ ID
+	*/
+	//need one arg
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting RFQ ID")
+	}
+
+	// Only the buyer that opened the RFQ can cancel it
+	buyer, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	rfq, err := GetRFQ(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+	if rfq.Buyer != buyer {
+		fmt.Println("RFQ " + rfq.ID + " doesn't belong to " + buyer)
+		return nil, errors.New("RFQ " + rfq.ID + " doesn't belong to " + buyer)
+	}
+	if rfq.Status != rfqOpen {
+		fmt.Println("RFQ " + rfq.ID + " is " + rfq.Status)
+		return nil, errors.New("RFQ " + rfq.ID + " is " + rfq.Status + " and can't be cancelled")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		fmt.Println("Error getting transaction timestamp")
+		return nil, errors.New("Error getting transaction timestamp: " + err.Error())
+	}
+
+	expireQuotes(&rfq, now)
+	for i, quote := range rfq.Quotes {
+		if quote.Status == quoteOpen {
+			rfq.Quotes[i].Status = quoteLost
+			logRFQ(&rfq, now, quoteLost, quote.Dealer, quote.ID)
+		}
+	}
+	rfq.Status = rfqCancelled
+	logRFQ(&rfq, now, rfqCancelled, rfq.Buyer, "")
+
+	err = putRFQ(stub, rfq)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Cancelled RFQ " + rfq.ID)
+	return nil, nil
+}
+
+// GetRFQs returns every RFQ the company opened or was invited to quote on,
+// with quotes past their expiry shown as expired when the query has a
+// timestamp
+func GetRFQs(companyID string, stub shim.ChaincodeStubInterface) ([]RFQ, error) {
+	rfqs := []RFQ{}
+
+	iter, err := stub.RangeQueryState(rfqPrefix, rfqPrefix + "~")
+	if err != nil {
+		fmt.Println("Error reading RFQs")
+		return nil, errors.New("Error reading RFQs: " + err.Error())
+	}
+	defer iter.Close()
+
+	now, timeErr := txTime(stub)
+	for iter.HasNext() {
+		key, rfqBytes, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Error reading RFQs: " + err.Error())
+		}
+		var rfq RFQ
+		err = json.Unmarshal(rfqBytes, &rfq)
+		if err != nil {
+			fmt.Println("Error unmarshalling " + key)
+			return nil, errors.New("Error unmarshalling " + key)
+		}
+
+		involved := rfq.Buyer == companyID
+		for _, dealer := range rfq.Dealers {
+			if dealer == companyID {
+				involved = true
+			}
+		}
+		if !involved {
+			continue
+		}
+		if timeErr == nil && rfq.Status == rfqOpen {
+			expireQuotes(&rfq, now)
+		}
+		rfqs = append(rfqs, rfq)
+	}
+
+	fmt.Println("Found " + strconv.Itoa(len(rfqs)) + " RFQs for " + companyID)
+	return rfqs, nil
+}
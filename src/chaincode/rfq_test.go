@@ -0,0 +1,68 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRFQParties(t *testing.T) {
+	cc, stub := newTestStub(t)
+	cusip := issueTestPaper(t, stub, cc, nil)
+	rfqID := string(mustInvoke(t, stub, cc, "company2", "openRFQ", toJSON(t, map[string]interface{}{
+		"cusip":    cusip,
+		"quantity": 3,
+		"dealers":  []string{"company1", "company3"},
+	})))
+
+	// Only invited dealers quote, for themselves
+	quote := toJSON(t, map[string]interface{}{
+		"rfq":      rfqID,
+		"discount": 3.6,
+		"expiry":   ms(stub.now.Add(time.Hour)),
+	})
+	for _, caller := range []string{"company2", "company4", ""} {
+		_, err := invoke(stub, cc, caller, "submitQuote", quote)
+		if err == nil {
+			t.Errorf("%q quoted on an RFQ it isn't invited to", caller)
+		}
+	}
+	quoteID := string(mustInvoke(t, stub, cc, "company1", "submitQuote", quote))
+
+	// Only the buyer can accept or cancel
+	accept := toJSON(t, map[string]interface{}{"rfq": rfqID, "quote": quoteID})
+	for _, caller := range []string{"company1", "company3", ""} {
+		_, err := invoke(stub, cc, caller, "acceptQuote", accept)
+		if err == nil {
+			t.Errorf("%q accepted company2's quote", caller)
+		}
+		_, err = invoke(stub, cc, caller, "cancelRFQ", rfqID)
+		if err == nil {
+			t.Errorf("%q cancelled company2's RFQ", caller)
+		}
+	}
+	mustInvoke(t, stub, cc, "company2", "acceptQuote", accept)
+
+	expectHoldings(t, stub, cusip, map[string]int{"company1": 7, "company2": 3})
+	expectCash(t, stub, map[string]Money{
+		"company1": initialCashBalance + 299100,
+		"company2": initialCashBalance - 299100,
+	})
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// transferTestPaper has the seller propose a transfer and the buyer accept it
+func transferTestPaper(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string, from string, to string, quantity int, net bool) {
+	t.Helper()
+	var proposal Proposal
+	err := json.Unmarshal(mustInvoke(t, stub, cc, from, "transferPaper", toJSON(t, map[string]interface{}{
+		"CUSIP":       cusip,
+		"fromCompany": from,
+		"toCompany":   to,
+		"quantity":    quantity,
+		"net":         net,
+	})), &proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInvoke(t, stub, cc, to, "acceptTransfer", proposal.ID)
+}
+
+// TestSettlementPaths runs each way paper and cash change hands on 10 units
+// of 30 day paper issued by company1 at a 3.6 discount, 997.00 a unit at
+// issue, and checks the owners and cash balances afterwards
+func TestSettlementPaths(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		terms    map[string]interface{}
+		settle   func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string)
+		holdings map[string]int
+		cash     map[string]Money
+	}{
+		{
+			name: "transfer",
+			settle: func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {
+				transferTestPaper(t, stub, cc, cusip, "company1", "company2", 3, false)
+			},
+			holdings: map[string]int{"company1": 7, "company2": 3},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 299100,
+				"company2": initialCashBalance - 299100,
+			},
+		},
+		{
+			name: "primary sale at issue",
+			terms: map[string]interface{}{
+				"owners": []map[string]interface{}{{"company": "company2", "quantity": 4}, {"company": "company3", "quantity": 1}},
+			},
+			settle:   func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {},
+			holdings: map[string]int{"company1": 5, "company2": 4, "company3": 1},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 398800 + 99700,
+				"company2": initialCashBalance - 398800,
+				"company3": initialCashBalance - 99700,
+			},
+		},
+		{
+			name: "allocation after issue",
+			settle: func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {
+				stub.now = stub.now.AddDate(0, 0, 10)
+				mustInvoke(t, stub, cc, "company1", "allocatePaper", toJSON(t, map[string]interface{}{
+					"cusip":       cusip,
+					"allocations": []map[string]interface{}{{"company": "company3", "quantity": 4}},
+				}))
+			},
+			holdings: map[string]int{"company1": 6, "company3": 4},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 399200,
+				"company3": initialCashBalance - 399200,
+			},
+		},
+		{
+			name: "redemption",
+			settle: func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {
+				transferTestPaper(t, stub, cc, cusip, "company1", "company2", 3, false)
+				stub.now = stub.now.AddDate(0, 0, 30)
+				mustInvoke(t, stub, cc, "company1", "redeemPaper", cusip)
+			},
+			holdings: map[string]int{"company1": 7, "company2": 3},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 299100 - 300000,
+				"company2": initialCashBalance - 299100 + 300000,
+			},
+		},
+		{
+			name: "call",
+			settle: func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {
+				transferTestPaper(t, stub, cc, cusip, "company1", "company2", 3, false)
+				stub.now = stub.now.AddDate(0, 0, 10)
+				mustInvoke(t, stub, cc, "company1", "callPaper", toJSON(t, map[string]interface{}{"cusip": cusip}))
+			},
+			holdings: map[string]int{"company1": 0, "company2": 0},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 299100 - 299400,
+				"company2": initialCashBalance - 299100 + 299400,
+			},
+		},
+		{
+			name: "default and recovery",
+			settle: func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {
+				transferTestPaper(t, stub, cc, cusip, "company1", "company2", 3, false)
+
+				// With its cash on hold the issuer can't redeem, and only
+				// what is free is recovered until the hold is released
+				holdID := string(mustInvoke(t, stub, cc, "company1", "placeHold", toJSON(t, map[string]interface{}{
+					"currency": "USD",
+					"amount":   10000000.00,
+					"reason":   "frozen",
+					"expiry":   ms(stub.now.AddDate(0, 0, 60)),
+				})))
+				stub.now = stub.now.AddDate(0, 0, 30)
+				mustInvoke(t, stub, cc, "company1", "declareDefault", cusip)
+				mustInvoke(t, stub, cc, "company1", "distributeRecovery", cusip)
+				mustInvoke(t, stub, cc, "company1", "releaseHold", holdID)
+				mustInvoke(t, stub, cc, "company1", "distributeRecovery", cusip)
+			},
+			holdings: map[string]int{"company1": 7, "company2": 3},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 299100 - 299100 - 900,
+				"company2": initialCashBalance - 299100 + 299100 + 900,
+			},
+		},
+		{
+			name: "net settlement",
+			settle: func(t *testing.T, stub *testStub, cc *SimpleChaincode, cusip string) {
+				transferTestPaper(t, stub, cc, cusip, "company1", "company2", 5, true)
+				transferTestPaper(t, stub, cc, cusip, "company2", "company1", 2, true)
+				mustInvoke(t, stub, cc, "company3", "netSettle")
+			},
+			holdings: map[string]int{"company1": 7, "company2": 3},
+			cash: map[string]Money{
+				"company1": initialCashBalance + 498500 - 199400,
+				"company2": initialCashBalance - 498500 + 199400,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cc, stub := newTestStub(t)
+			cusip := issueTestPaper(t, stub, cc, test.terms)
+			test.settle(t, stub, cc, cusip)
+			expectHoldings(t, stub, cusip, test.holdings)
+			expectCash(t, stub, test.cash)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2016 IBM
+
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+Licensed Materials - Property of IBM
+© Copyright IBM Corp. 2016
+*/
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// testStub is a mock stub with a settable transaction time and caller
+// certificate, and range queries over the mock state. The chaincode is run
+// against chaincodeStub, which adds the transaction time.
+type testStub struct {
+	*shim.MockStub
+	now           time.Time
+	caller        string
+	txs           int
+	chaincodeStub shim.ChaincodeStubInterface
+}
+
+// timedStub answers GetTxTimestamp from the test stub's clock. The
+// timestamp type is only visible inside the fabric tree, so it is taken
+// from the mock stub's own method.
+type timedStub[T any] struct {
+	*testStub
+}
+
+func newTimedStub[T any](stub *testStub, _ func() (T, error)) timedStub[T] {
+	return timedStub[T]{stub}
+}
+
+func (stub timedStub[T]) GetTxTimestamp() (T, error) {
+	var ts T
+	value := reflect.New(reflect.TypeOf(ts).Elem())
+	value.Elem().FieldByName("Seconds").SetInt(stub.now.Unix())
+	value.Elem().FieldByName("Nanos").SetInt(int64(stub.now.Nanosecond()))
+	return value.Interface().(T), nil
+}
+
+var testStart = time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testAdmin is a caller whose certificate carries the admin role
+var testAdmin = "admin"
+
+func newTestStub(t *testing.T) (*SimpleChaincode, *testStub) {
+	cc := new(SimpleChaincode)
+	stub := &testStub{MockStub: shim.NewMockStub("cp", cc), now: testStart}
+	stub.chaincodeStub = newTimedStub(stub, stub.MockStub.GetTxTimestamp)
+
+	stub.MockTransactionStart("init")
+	defer stub.MockTransactionEnd("init")
+	_, err := cc.Init(stub.chaincodeStub, "init", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cc.createAccounts(stub.chaincodeStub, []string{"5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cc, stub
+}
+
+func (stub *testStub) ReadCertAttribute(name string) ([]byte, error) {
+	if name == accountAttribute {
+		return []byte(stub.caller), nil
+	}
+	if name == roleAttribute && stub.caller == testAdmin {
+		return []byte(adminRole), nil
+	}
+	return nil, nil
+}
+
+type testIterator struct {
+	stub *testStub
+	keys []string
+}
+
+func (iter *testIterator) HasNext() bool {
+	return len(iter.keys) > 0
+}
+
+func (iter *testIterator) Next() (string, []byte, error) {
+	key := iter.keys[0]
+	iter.keys = iter.keys[1:]
+	value, err := iter.stub.GetState(key)
+	return key, value, err
+}
+
+func (iter *testIterator) Close() error {
+	return nil
+}
+
+func (stub *testStub) RangeQueryState(startKey, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	var keys []string
+	for e := stub.Keys.Front(); e != nil; e = e.Next() {
+		key := e.Value.(string)
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &testIterator{stub: stub, keys: keys}, nil
+}
+
+// invoke runs an invoke as the given company in a transaction of its own
+func invoke(stub *testStub, cc *SimpleChaincode, caller string, function string, args ...string) ([]byte, error) {
+	stub.txs++
+	txID := "tx" + strconv.Itoa(stub.txs)
+	stub.caller = caller
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return cc.Invoke(stub.chaincodeStub, function, args)
+}
+
+// query runs a query as the given company
+func query(stub *testStub, cc *SimpleChaincode, caller string, function string, args ...string) ([]byte, error) {
+	stub.caller = caller
+	return cc.Query(stub.chaincodeStub, function, args)
+}
+
+// mustInvoke runs an invoke that has to succeed
+func mustInvoke(t *testing.T, stub *testStub, cc *SimpleChaincode, caller string, function string, args ...string) []byte {
+	t.Helper()
+	result, err := invoke(stub, cc, caller, function, args...)
+	if err != nil {
+		t.Fatalf("%s by %s: %v", function, caller, err)
+	}
+	return result
+}
+
+func toJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func ms(at time.Time) string {
+	return timeToMs(at)
+}
+
+// issueTestPaper issues 10 units of 30 day paper at a 3.6 discount from
+// company1, with any terms given replacing the defaults, and returns its
+// CUSIP
+func issueTestPaper(t *testing.T, stub *testStub, cc *SimpleChaincode, terms map[string]interface{}) string {
+	paper := map[string]interface{}{
+		"ticker":    "ABC",
+		"par":       1000.00,
+		"qty":       10,
+		"discount":  3.6,
+		"maturity":  30,
+		"issuer":    "company1",
+		"issueDate": ms(stub.now),
+	}
+	for key, value := range terms {
+		paper[key] = value
+	}
+	mustInvoke(t, stub, cc, paper["issuer"].(string), "issueCommercialPaper", toJSON(t, paper))
+
+	allCPs, err := GetAllCPs(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return allCPs[len(allCPs) - 1].CUSIP
+}
+
+func cashOf(t *testing.T, stub *testStub, company string) Money {
+	account, err := GetCompany(company, stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account.CashBalance
+}
+
+func heldBy(t *testing.T, stub *testStub, cusip string, company string) int {
+	cp, err := GetCP(cpPrefix + cusip, stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range cp.Owners {
+		if owner.Company == company {
+			return owner.Quantity
+		}
+	}
+	return 0
+}
+
+// expectHoldings checks what each company holds of the paper
+func expectHoldings(t *testing.T, stub *testStub, cusip string, holdings map[string]int) {
+	t.Helper()
+	for company, quantity := range holdings {
+		if held := heldBy(t, stub, cusip, company); held != quantity {
+			t.Errorf("%s holds %d of %s, want %d", company, held, cusip, quantity)
+		}
+	}
+}
+
+// expectCash checks each company's cash balance
+func expectCash(t *testing.T, stub *testStub, balances map[string]Money) {
+	t.Helper()
+	for company, balance := range balances {
+		if cash := cashOf(t, stub, company); cash != balance {
+			t.Errorf("%s has %s cash, want %s", company, cash, balance)
+		}
+	}
+}
@@ -120,7 +120,8 @@ CPChaincode.prototype.createPaper = function(enrollID, paper, cb) {
 };
 
 /**
- * Invoke the chaincode to transfer ownership of a commercial paper.
+ * Invoke the chaincode to propose transferring a commercial paper.  The user must be the seller and the transfer waits
+ * as a proposal until the buyer accepts it.
  * @param enrollID The user that the invoke should be submitted through.
  * @param paper The object representing the transfer information.  See chaincode for more info.
  * @param cb A callback of the form: function(error, result)
@@ -146,6 +147,85 @@ CPChaincode.prototype.transferPaper = function(enrollID, paper, cb) {
     });
 };
 
+/**
+ * Invoke the chaincode to accept a transfer proposed to the user, which settles it.
+ * @param enrollID The user that the invoke should be submitted through.  Must be the buyer on the proposal.
+ * @param proposalID The ID of the transfer proposal.
+ * @param cb A callback of the form: function(error, result)
+ */
+CPChaincode.prototype.acceptTransfer = function(enrollID, proposalID, cb) {
+    console.log(TAG, 'accepting a transfer proposal');
+
+    var acceptRequest = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'acceptTransfer',
+        args: [proposalID]
+    };
+
+    invoke(this.chain, enrollID, acceptRequest, function(err, result) {
+        if(err) {
+            console.error(TAG, 'failed to accept transfer:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'Accepted transfer successfully:', result.toString());
+        cb(null, result);
+    });
+};
+
+/**
+ * Invoke the chaincode to reject a transfer proposed to the user.
+ * @param enrollID The user that the invoke should be submitted through.  Must be the buyer on the proposal.
+ * @param proposalID The ID of the transfer proposal.
+ * @param cb A callback of the form: function(error, result)
+ */
+CPChaincode.prototype.rejectTransfer = function(enrollID, proposalID, cb) {
+    console.log(TAG, 'rejecting a transfer proposal');
+
+    var rejectRequest = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'rejectTransfer',
+        args: [proposalID]
+    };
+
+    invoke(this.chain, enrollID, rejectRequest, function(err, result) {
+        if(err) {
+            console.error(TAG, 'failed to reject transfer:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'Rejected transfer successfully:', result.toString());
+        cb(null, result);
+    });
+};
+
+/**
+ * Query the chaincode for the pending transfer proposals a company is the buyer or seller on.
+ * @param enrollID The user that the query should be submitted through.
+ * @param company The name of the company.
+ * @param cb A callback of the form: function(error, proposals)
+ */
+CPChaincode.prototype.getProposals = function(enrollID, company, cb) {
+    console.log(TAG, 'getting transfer proposals for', company);
+
+    var getProposalsRequest = {
+        chaincodeID: this.chaincodeID,
+        fcn: 'GetProposals',
+        args: [company]
+    };
+
+    query(this.chain, enrollID, getProposalsRequest, function(err, proposals) {
+
+        if(err) {
+            console.error(TAG, 'failed to getProposals:', err);
+            return cb(err);
+        }
+
+        console.log(TAG, 'got proposals');
+        cb(null, proposals.toString());
+    });
+};
+
 /**
  * Query the chaincode for the full list of commercial papers.
  * @param enrollID The user that the query should be submitted through.
@@ -191,6 +271,9 @@ function invoke(chain, enrollID, requestBody, cb) {
         } else {
             console.log(TAG, 'successfully got member:', enrollID);
 
+            // The chaincode reads the account the user trades for from the transaction certificate
+            requestBody.attrs = ['account'];
+
             console.log(TAG, 'invoke body:', JSON.stringify(requestBody));
             var invokeTx = usr.invoke(requestBody);
 
@@ -232,6 +315,9 @@ function query(chain, enrollID, requestBody, cb) {
         } else {
             console.log(TAG, 'successfully got member:', enrollID);
 
+            // Sealed data, like auction bids, is only shown to the account in the certificate
+            requestBody.attrs = ['account'];
+
             console.log(TAG, 'query body:', JSON.stringify(requestBody));
             var queryTx = usr.query(requestBody);
 
@@ -87,9 +87,11 @@ module.exports = function (myChain, useTLS) {
                 // Hack to make registration work for local and bluemix blockchain networks
                 let affiliation = 'institution_a';
                 if (tls) affiliation = 'group1';
+                // The chaincode reads the account a user trades for from this attribute
                 let registrationRequest = {
                     enrollmentID: enrollID,
-                    affiliation: affiliation
+                    affiliation: affiliation,
+                    attributes: [{name: 'account', value: enrollID}]
                 };
                 usr.register(registrationRequest, function (err, enrollSecret) {
                     if (err) {
@@ -113,6 +113,50 @@ module.exports.process_msg = function (socket, data) {
                 console.log(TAG, 'Queued transfer_paper job complete');
         });
     }
+    else if (data.type == 'accept_transfer' || data.type == 'reject_transfer') {
+
+        console.log(TAG, 'answering transfer proposal:', data.type, data.proposal);
+        chaincodeHelper.queue.push(function (cb) {
+            var answer = data.type == 'accept_transfer' ? chaincodeHelper.acceptTransfer : chaincodeHelper.rejectTransfer;
+            answer.call(chaincodeHelper, data.user, data.proposal, function (err, result) {
+                if (err != null) {
+                    console.error(TAG, 'Error in ' + data.type + '. No response will be sent. error:', err);
+                }
+                else {
+                    console.log(TAG, 'answered transfer proposal. No response will be sent result:', result);
+                }
+
+                cb();
+            });
+        }, function (err) {
+            if (err)
+                console.error(TAG, 'Queued ' + data.type + ' error:', err.message);
+            else
+                console.log(TAG, 'Queued ' + data.type + ' job complete');
+        });
+    }
+    else if (data.type == 'get_proposals') {
+
+        console.log(TAG, 'getting transfer proposals');
+        chaincodeHelper.queue.push(function (cb) {
+            chaincodeHelper.getProposals(data.user, data.company, function (err, proposals) {
+                if (err != null) {
+                    console.error(TAG, 'Error in get_proposals. No response will be sent. error:', err);
+                }
+                else {
+                    console.log(TAG, 'got proposals:', proposals);
+                    sendMsg({msg: 'proposals', proposals: proposals});
+                }
+
+                cb();
+            });
+        }, function (err) {
+            if (err)
+                console.error(TAG, 'Queued get_proposals error:', err.message);
+            else
+                console.log(TAG, 'Queued get_proposals job complete');
+        });
+    }
     else if (data.type == 'get_company') {
 
         console.log(TAG, 'getting company information');